@@ -0,0 +1,247 @@
+// Package arc implements low-level primitives for the Authenticated Received
+// Chain (ARC), as specified in RFC 8617.
+//
+// This package doesn't perform a full ARC chain validation yet. It only
+// provides building blocks, mainly useful for interoperability testing.
+package arc
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	headerAuthResults = "ARC-Authentication-Results"
+	headerMsgSig      = "ARC-Message-Signature"
+	headerSeal        = "ARC-Seal"
+)
+
+// maxInstance is the maximum number of ARC sets in a chain, as defined in RFC
+// 8617 section 4.2.1.
+const maxInstance = 50
+
+// PublicKey is a public key used to verify ARC signatures. ARC uses the same
+// key records as DKIM.
+type PublicKey struct {
+	// Either an *rsa.PublicKey or an ed25519.PublicKey.
+	Key crypto.PublicKey
+}
+
+// ParsePublicKey parses a DKIM key record, as published in DNS TXT records.
+// RSA keys shorter than 1024 bits are rejected, as required by RFC 8301.
+func ParsePublicKey(s string) (*PublicKey, error) {
+	pub, err := dkim.ParsePublicKey(s)
+	if err != nil {
+		return nil, err
+	}
+	return &PublicKey{pub.Key}, nil
+}
+
+// VerifySeal checks the ARC-Seal header field of the given instance, as
+// defined in RFC 8617 section 5.1.1. The seal covers all ARC sets up to and
+// including this instance.
+//
+// headers contains the raw header fields of the message, each terminated with
+// CRLF. Only ARC header fields are taken into account. The DNS lookup of the
+// key is left to the caller.
+//
+// The chain validation status ("cv=" tag) of the seal isn't interpreted.
+func VerifySeal(headers []string, instance int, key *PublicKey) error {
+	if key == nil || key.Key == nil {
+		return errors.New("arc: missing public key")
+	}
+	if instance < 1 || instance > maxInstance {
+		return fmt.Errorf("arc: invalid instance %v", instance)
+	}
+
+	sets := make([]arcSet, instance)
+	for _, kv := range headers {
+		k, v, ok := strings.Cut(kv, ":")
+		if !ok {
+			continue
+		}
+		k = strings.TrimSpace(k)
+		if !strings.EqualFold(k, headerAuthResults) && !strings.EqualFold(k, headerMsgSig) && !strings.EqualFold(k, headerSeal) {
+			continue
+		}
+
+		i, err := parseInstance(k, v)
+		if err != nil {
+			return err
+		}
+		if i > instance {
+			continue
+		}
+
+		var field *string
+		switch {
+		case strings.EqualFold(k, headerAuthResults):
+			field = &sets[i-1].authResults
+		case strings.EqualFold(k, headerMsgSig):
+			field = &sets[i-1].msgSig
+		default:
+			field = &sets[i-1].seal
+		}
+		if *field != "" {
+			return fmt.Errorf("arc: duplicate %v header field for instance %v", k, i)
+		}
+		*field = kv
+	}
+
+	for i, set := range sets {
+		if set.authResults == "" || set.msgSig == "" || set.seal == "" {
+			return fmt.Errorf("arc: incomplete ARC set for instance %v", i+1)
+		}
+	}
+
+	_, sealValue, _ := strings.Cut(sets[instance-1].seal, ":")
+	params, err := parseTags(sealValue)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(stripWhitespace(params["b"]))
+	if err != nil {
+		return fmt.Errorf("arc: malformed seal signature: %v", err)
+	}
+
+	hashed, err := sealHash(sets)
+	if err != nil {
+		return err
+	}
+	switch stripWhitespace(params["a"]) {
+	case "rsa-sha256":
+		pub, ok := key.Key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("arc: key algorithm doesn't match the seal")
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed, sig); err != nil {
+			return fmt.Errorf("arc: seal did not verify: %v", err)
+		}
+	case "ed25519-sha256":
+		pub, ok := key.Key.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("arc: key algorithm doesn't match the seal")
+		}
+		if !ed25519.Verify(pub, hashed, sig) {
+			return errors.New("arc: seal did not verify")
+		}
+	default:
+		return errors.New("arc: unsupported seal algorithm")
+	}
+	return nil
+}
+
+type arcSet struct {
+	authResults, msgSig, seal string
+}
+
+// sealHash computes the hash signed by the ARC-Seal of the last set. The ARC
+// sets are hashed in increasing instance order, each in the order
+// ARC-Authentication-Results, ARC-Message-Signature, ARC-Seal. The "b=" tag
+// value of the last ARC-Seal is removed.
+func sealHash(sets []arcSet) ([]byte, error) {
+	h := sha256.New()
+	for i, set := range sets {
+		fields := []string{set.authResults, set.msgSig, set.seal}
+		last := i == len(sets)-1
+		if last {
+			fields[2] = sigRegex.ReplaceAllString(set.seal, "$1")
+		}
+		for j, kv := range fields {
+			canon, err := canonicalizeHeader(kv)
+			if err != nil {
+				return nil, err
+			}
+			if last && j == 2 {
+				canon = strings.TrimRight(canon, "\r\n")
+			}
+			h.Write([]byte(canon))
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// sigRegex matches the "b=" tag value of an ARC-Seal header field.
+var sigRegex = regexp.MustCompile(`((?:^|[:;])\s*b\s*=)[^;]+`)
+
+func parseInstance(k, v string) (int, error) {
+	if strings.EqualFold(k, headerAuthResults) {
+		// The instance is the first item of ARC-Authentication-Results
+		item, _, _ := strings.Cut(v, ";")
+		tag, value, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(tag) != "i" {
+			return 0, fmt.Errorf("arc: missing instance in %v header field", k)
+		}
+		return parseInstanceValue(k, value)
+	}
+
+	params, err := parseTags(v)
+	if err != nil {
+		return 0, err
+	}
+	s, ok := params["i"]
+	if !ok {
+		return 0, fmt.Errorf("arc: missing instance in %v header field", k)
+	}
+	return parseInstanceValue(k, s)
+}
+
+func parseInstanceValue(k, s string) (int, error) {
+	i, err := strconv.Atoi(stripWhitespace(s))
+	if err != nil || i < 1 || i > maxInstance {
+		return 0, fmt.Errorf("arc: malformed instance in %v header field", k)
+	}
+	return i, nil
+}
+
+func parseTags(s string) (map[string]string, error) {
+	params := make(map[string]string)
+	for _, s := range strings.Split(s, ";") {
+		k, v, ok := strings.Cut(s, "=")
+		if !ok {
+			if strings.TrimSpace(s) == "" {
+				continue
+			}
+			return nil, errors.New("arc: malformed tag list")
+		}
+		params[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return params, nil
+}
+
+// canonicalizeHeader applies the "relaxed" header canonicalization, the only
+// one allowed for ARC-Seal, to a header field.
+func canonicalizeHeader(kv string) (string, error) {
+	k, _, _ := strings.Cut(kv, ":")
+	if !strings.HasSuffix(kv, "\n") {
+		kv += "\r\n"
+	}
+	msg := strings.NewReader(kv + "\r\n")
+	h, _, err := dkim.CanonicalizeMessage(msg, []string{strings.TrimSpace(k)}, dkim.CanonicalizationRelaxed, dkim.CanonicalizationSimple)
+	return string(h), err
+}
+
+// stripWhitespace removes the folding whitespace which may appear in tag
+// values, e.g. in a folded "b=" signature.
+func stripWhitespace(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; ch {
+		case ' ', '\t', '\r', '\n':
+		default:
+			sb.WriteByte(ch)
+		}
+	}
+	return sb.String()
+}
@@ -8,7 +8,7 @@ import (
 
 // Format formats an Authentication-Results header.
 func Format(identity string, results []Result) string {
-	s := identity
+	s := formatValue(identity)
 
 	if len(results) == 0 {
 		s += "; none"
@@ -19,7 +19,11 @@ func Format(identity string, results []Result) string {
 		method := resultMethod(r)
 		value, params := r.format()
 
-		s += "; " + method + "=" + string(value) + " " + formatParams(params)
+		s += "; " + method + "=" + string(value) + " "
+		if comment := resultComment(r); comment != "" {
+			s += formatComment(comment) + " "
+		}
+		s += formatParams(params)
 	}
 
 	return s
@@ -27,6 +31,8 @@ func Format(identity string, results []Result) string {
 
 func resultMethod(r Result) string {
 	switch r := r.(type) {
+	case *ARCResult:
+		return "arc"
 	case *AuthResult:
 		return "auth"
 	case *DKIMResult:
@@ -48,6 +54,36 @@ func resultMethod(r Result) string {
 	}
 }
 
+func resultComment(r Result) string {
+	switch r := r.(type) {
+	case *ARCResult:
+		return r.Comment
+	case *AuthResult:
+		return r.Comment
+	case *DKIMResult:
+		return r.Comment
+	case *DomainKeysResult:
+		return r.Comment
+	case *IPRevResult:
+		return r.Comment
+	case *SenderIDResult:
+		return r.Comment
+	case *SPFResult:
+		return r.Comment
+	case *DMARCResult:
+		return r.Comment
+	case *GenericResult:
+		return r.Comment
+	default:
+		return ""
+	}
+}
+
+func formatComment(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`).Replace(s)
+	return "(" + s + ")"
+}
+
 func formatParams(params map[string]string) string {
 	keys := make([]string, 0, len(params))
 	for k := range params {
@@ -109,6 +145,7 @@ func formatValue(s string) string {
 	}
 
 	if shouldQuote {
+		s = strings.Replace(s, `\`, `\\`, -1)
 		return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
 	}
 	return s
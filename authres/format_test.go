@@ -12,3 +12,13 @@ func TestFormat(t *testing.T) {
 		}
 	}
 }
+
+func TestFormat_arcInvalidOldestPass(t *testing.T) {
+	results := []Result{
+		&ARCResult{Value: ResultPass, RemoteIP: "192.0.2.1", OldestPass: -1},
+	}
+	want := "example.com; arc=pass smtp.remote-ip=192.0.2.1"
+	if v := Format("example.com", results); v != want {
+		t.Errorf("Expected formatted header field to be \n%q\n but got \n%q", want, v)
+	}
+}
@@ -0,0 +1,36 @@
+package authres
+
+import (
+	"testing"
+)
+
+func FuzzAuthresParse(f *testing.F) {
+	for _, test := range msgauthTests {
+		f.Add(test.value)
+	}
+	for _, test := range parseTests {
+		f.Add(test.value)
+	}
+
+	f.Fuzz(func(t *testing.T, value string) {
+		identity, results, err := Parse(value)
+		if err != nil {
+			return
+		}
+
+		// Comments, empty and unknown properties may be dropped, so
+		// formatting the parsed value doesn't necessarily give it back.
+		// However formatting and parsing again must be stable.
+		formatted := Format(identity, results)
+		identity2, results2, err := Parse(formatted)
+		if err != nil {
+			t.Fatalf("Parse(%q) = %v", formatted, err)
+		}
+		if identity2 != identity {
+			t.Errorf("Parse(%q) identity = %q, want %q", formatted, identity2, identity)
+		}
+		if formatted2 := Format(identity2, results2); formatted2 != formatted {
+			t.Errorf("Format(Parse(%q)) = %q", formatted, formatted2)
+		}
+	})
+}
@@ -35,6 +35,36 @@ var msgauthTests = []msgauthTest{
 			&SPFResult{Value: ResultFail, Reason: "bad", From: "example.net"},
 		},
 	},
+	{
+		value: "example.com;" +
+			` dkim=fail reason="signature \"b=\" did not verify" header.d="example.net;org"`,
+		identifier: "example.com",
+		results: []Result{
+			&DKIMResult{
+				Value:  ResultFail,
+				Reason: `signature "b=" did not verify`,
+				Domain: "example.net;org",
+			},
+		},
+	},
+	{
+		value: "example.com;" +
+			` dkim=fail reason="bad signature, 512-bit key" header.d=example.org`,
+		identifier: "example.com",
+		results: []Result{
+			&DKIMResult{Value: ResultFail, Reason: "bad signature, 512-bit key", Domain: "example.org"},
+		},
+	},
+	{
+		value: "example.com;" +
+			` auth=fail reason="unknown user" smtp.auth=sender@example.com;` +
+			` dmarc=fail reason="policy is reject, not aligned" header.from=example.com`,
+		identifier: "example.com",
+		results: []Result{
+			&AuthResult{Value: ResultFail, Reason: "unknown user", Auth: "sender@example.com"},
+			&DMARCResult{Value: ResultFail, Reason: "policy is reject, not aligned", From: "example.com"},
+		},
+	},
 	{
 		value: "example.com;" +
 			" auth=pass smtp.auth=sender@example.com;" +
@@ -83,4 +113,88 @@ var msgauthTests = []msgauthTest{
 			&DKIMResult{Value: ResultFail, Identifier: "@newyork.example.com"},
 		},
 	},
+	{
+		value: "example.com;" +
+			" arc=pass smtp.remote-ip=192.0.2.1",
+		identifier: "example.com",
+		results: []Result{
+			&ARCResult{Value: ResultPass, RemoteIP: "192.0.2.1"},
+		},
+	},
+	{
+		value: "example.com;" +
+			" arc=pass header.oldest-pass=2 smtp.remote-ip=192.0.2.1",
+		identifier: "example.com",
+		results: []Result{
+			&ARCResult{Value: ResultPass, RemoteIP: "192.0.2.1", OldestPass: 2},
+		},
+	},
+	{
+		value: "example.com;" +
+			" dmarc=pass header.from=example.com policy.published-domain-policy=reject",
+		identifier: "example.com",
+		results: []Result{
+			&DMARCResult{
+				Value: ResultPass,
+				From:  "example.com",
+				Extra: map[string]string{"policy.published-domain-policy": "reject"},
+			},
+		},
+	},
+	{
+		value: "example.com;" +
+			" spf=pass policy.ptr=example.net smtp.mailfrom=example.net",
+		identifier: "example.com",
+		results: []Result{
+			&SPFResult{
+				Value: ResultPass,
+				From:  "example.net",
+				Extra: map[string]string{"policy.ptr": "example.net"},
+			},
+		},
+	},
+	{
+		value: "example.com;" +
+			" dkim=fail (512-bit key) header.i=@d1.example",
+		identifier: "example.com",
+		results: []Result{
+			&DKIMResult{Value: ResultFail, Comment: "512-bit key", Identifier: "@d1.example"},
+		},
+	},
+	{
+		value: "example.com;" +
+			" dkim=pass header.b=AbC+dE/f header.d=example.org",
+		identifier: "example.com",
+		results: []Result{
+			&DKIMResult{Value: ResultPass, Domain: "example.org", SignaturePrefix: "AbC+dE/f"},
+		},
+	},
+	{
+		value: "example.com;" +
+			" dkim=pass header.a=rsa-sha256 header.b=AbC+dE/f header.d=example.org",
+		identifier: "example.com",
+		results: []Result{
+			&DKIMResult{Value: ResultPass, Domain: "example.org", SignaturePrefix: "AbC+dE/f", Algorithm: "rsa-sha256"},
+		},
+	},
+	{
+		value: "example.com;" +
+			" dkim=pass header.d=example.com header.s=selector1",
+		identifier: "example.com",
+		results: []Result{
+			&DKIMResult{Value: ResultPass, Domain: "example.com", Selector: "selector1"},
+		},
+	},
+	{
+		value: "example.com;" +
+			" bimi=pass header.d=example.org header.selector=default",
+		identifier: "example.com",
+		results: []Result{
+			&GenericResult{
+				Method: "bimi",
+				Value:  ResultPass,
+				Params: map[string]string{"header.d": "example.org", "header.selector": "default"},
+			},
+		},
+	},
 }
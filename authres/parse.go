@@ -31,9 +31,10 @@ type Result interface {
 }
 
 type AuthResult struct {
-	Value  ResultValue
-	Reason string
-	Auth   string
+	Value   ResultValue
+	Reason  string
+	Comment string
+	Auth    string
 }
 
 func (r *AuthResult) parse(value ResultValue, params map[string]string) error {
@@ -44,14 +45,25 @@ func (r *AuthResult) parse(value ResultValue, params map[string]string) error {
 }
 
 func (r *AuthResult) format() (ResultValue, map[string]string) {
-	return r.Value, map[string]string{"smtp.auth": r.Auth}
+	return r.Value, map[string]string{
+		"reason":    r.Reason,
+		"smtp.auth": r.Auth,
+	}
 }
 
 type DKIMResult struct {
 	Value      ResultValue
 	Reason     string
+	Comment    string
 	Domain     string
 	Identifier string
+	// A prefix of the signature's "b=" tag value, used to identify the
+	// signature when a message has several of them.
+	SignaturePrefix string
+	// The signing algorithm, e.g. "rsa-sha256".
+	Algorithm string
+	// The selector used to look up the public key.
+	Selector string
 }
 
 func (r *DKIMResult) parse(value ResultValue, params map[string]string) error {
@@ -59,6 +71,9 @@ func (r *DKIMResult) parse(value ResultValue, params map[string]string) error {
 	r.Reason = params["reason"]
 	r.Domain = params["header.d"]
 	r.Identifier = params["header.i"]
+	r.SignaturePrefix = params["header.b"]
+	r.Algorithm = params["header.a"]
+	r.Selector = params["header.s"]
 	return nil
 }
 
@@ -67,15 +82,19 @@ func (r *DKIMResult) format() (ResultValue, map[string]string) {
 		"reason":   r.Reason,
 		"header.d": r.Domain,
 		"header.i": r.Identifier,
+		"header.b": r.SignaturePrefix,
+		"header.a": r.Algorithm,
+		"header.s": r.Selector,
 	}
 }
 
 type DomainKeysResult struct {
-	Value  ResultValue
-	Reason string
-	Domain string
-	From   string
-	Sender string
+	Value   ResultValue
+	Reason  string
+	Comment string
+	Domain  string
+	From    string
+	Sender  string
 }
 
 func (r *DomainKeysResult) parse(value ResultValue, params map[string]string) error {
@@ -97,9 +116,10 @@ func (r *DomainKeysResult) format() (ResultValue, map[string]string) {
 }
 
 type IPRevResult struct {
-	Value  ResultValue
-	Reason string
-	IP     string
+	Value   ResultValue
+	Reason  string
+	Comment string
+	IP      string
 }
 
 func (r *IPRevResult) parse(value ResultValue, params map[string]string) error {
@@ -119,6 +139,7 @@ func (r *IPRevResult) format() (ResultValue, map[string]string) {
 type SenderIDResult struct {
 	Value       ResultValue
 	Reason      string
+	Comment     string
 	HeaderKey   string
 	HeaderValue string
 }
@@ -146,10 +167,13 @@ func (r *SenderIDResult) format() (value ResultValue, params map[string]string)
 }
 
 type SPFResult struct {
-	Value  ResultValue
-	Reason string
-	From   string
-	Helo   string
+	Value   ResultValue
+	Reason  string
+	Comment string
+	From    string
+	Helo    string
+	// Unrecognized "policy.*" and "header.*" params.
+	Extra map[string]string
 }
 
 func (r *SPFResult) parse(value ResultValue, params map[string]string) error {
@@ -157,40 +181,85 @@ func (r *SPFResult) parse(value ResultValue, params map[string]string) error {
 	r.Reason = params["reason"]
 	r.From = params["smtp.mailfrom"]
 	r.Helo = params["smtp.helo"]
+	r.Extra = extraParams(params)
 	return nil
 }
 
 func (r *SPFResult) format() (ResultValue, map[string]string) {
-	return r.Value, map[string]string{
+	return r.Value, withExtraParams(map[string]string{
 		"reason":        r.Reason,
 		"smtp.mailfrom": r.From,
 		"smtp.helo":     r.Helo,
-	}
+	}, r.Extra)
 }
 
 type DMARCResult struct {
-	Value  ResultValue
-	Reason string
-	From   string
+	Value   ResultValue
+	Reason  string
+	Comment string
+	From    string
+	// Unrecognized "policy.*" and "header.*" params.
+	Extra map[string]string
 }
 
 func (r *DMARCResult) parse(value ResultValue, params map[string]string) error {
 	r.Value = value
 	r.Reason = params["reason"]
 	r.From = params["header.from"]
+	r.Extra = extraParams(params, "header.from")
 	return nil
 }
 
 func (r *DMARCResult) format() (ResultValue, map[string]string) {
-	return r.Value, map[string]string{
+	return r.Value, withExtraParams(map[string]string{
 		"reason":      r.Reason,
 		"header.from": r.From,
+	}, r.Extra)
+}
+
+// extraParams returns the "policy.*" and "header.*" params which aren't part
+// of known. It returns nil if there are none.
+func extraParams(params map[string]string, known ...string) map[string]string {
+	var extra map[string]string
+	for k, v := range params {
+		if !strings.HasPrefix(k, "policy.") && !strings.HasPrefix(k, "header.") {
+			continue
+		}
+		isKnown := false
+		for _, kk := range known {
+			if k == kk {
+				isKnown = true
+				break
+			}
+		}
+		if isKnown {
+			continue
+		}
+		if extra == nil {
+			extra = make(map[string]string)
+		}
+		extra[k] = v
+	}
+	return extra
+}
+
+// withExtraParams adds extra params to params. Params already present aren't
+// overwritten.
+func withExtraParams(params, extra map[string]string) map[string]string {
+	for k, v := range extra {
+		if _, ok := params[k]; !ok {
+			params[k] = v
+		}
 	}
+	return params
 }
 
 type ARCResult struct {
-	Value      ResultValue
-	RemoteIP   string
+	Value    ResultValue
+	Comment  string
+	RemoteIP string
+	// OldestPass is the oldest ARC set which passed validation. Values lower
+	// than 1 mean that it's unset and are omitted when formatting.
 	OldestPass int
 }
 
@@ -225,9 +294,10 @@ func (r *ARCResult) format() (ResultValue, map[string]string) {
 }
 
 type GenericResult struct {
-	Method string
-	Value  ResultValue
-	Params map[string]string
+	Method  string
+	Value   ResultValue
+	Comment string
+	Params  map[string]string
 }
 
 func (r *GenericResult) parse(value ResultValue, params map[string]string) error {
@@ -271,18 +341,19 @@ var results = map[string]newResultFunc{
 
 // Parse parses the provided Authentication-Results header field. It returns the
 // authentication service identifier and authentication results.
+//
+// Results with a malformed method or value are skipped.
 func Parse(v string) (identifier string, results []Result, err error) {
-	parts := strings.Split(v, ";")
+	parts := splitResults(v)
 
-	identifier = strings.TrimSpace(parts[0])
-	i := strings.IndexFunc(identifier, unicode.IsSpace)
-	if i > 0 {
-		version := strings.TrimSpace(identifier[i:])
-		if version != "1" {
+	tokens, _ := tokenize(parts[0])
+	if len(tokens) > 0 {
+		identifier = unquoteValue(tokens[0])
+	}
+	if len(tokens) > 1 {
+		if len(tokens) > 2 || tokens[1] != "1" {
 			return "", nil, errors.New("msgauth: unsupported version")
 		}
-
-		identifier = identifier[:i]
 	}
 
 	for i := 1; i < len(parts); i++ {
@@ -303,9 +374,7 @@ func Parse(v string) (identifier string, results []Result, err error) {
 }
 
 func parseResult(s string) (Result, error) {
-	// TODO: ignore header comments in parenthesis
-
-	parts := strings.Fields(s)
+	parts, comment := tokenize(s)
 	if len(parts) == 0 || parts[0] == "none" {
 		return nil, nil
 	}
@@ -314,12 +383,16 @@ func parseResult(s string) (Result, error) {
 	if err != nil {
 		return nil, err
 	}
+	if !isKeyword(k) || !isKeyword(v) {
+		// Skip the result, so that the other ones can still be used
+		return nil, nil
+	}
 	method, value := k, ResultValue(strings.ToLower(v))
 
 	params := make(map[string]string)
 	for i := 1; i < len(parts); i++ {
 		k, v, err := parseParam(parts[i])
-		if err != nil {
+		if err != nil || !isKeyword(k) {
 			continue
 		}
 
@@ -340,6 +413,7 @@ func parseResult(s string) (Result, error) {
 	}
 
 	err = r.parse(value, params)
+	setResultComment(r, comment)
 	return r, err
 }
 
@@ -348,5 +422,157 @@ func parseParam(s string) (k string, v string, err error) {
 	if !ok {
 		return "", "", errors.New("msgauth: malformed authentication method and value")
 	}
-	return strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v), nil
+	return strings.ToLower(strings.TrimSpace(k)), unquoteValue(strings.TrimSpace(v)), nil
+}
+
+// isKeyword checks whether s is made of letters, digits, hyphens and the
+// separators used in method versions and property names.
+func isKeyword(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, ch := range s {
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+		case ch == '-', ch == '.', ch == '_', ch == '/':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// unquoteValue removes the quotes around a quoted-string, and unescapes its
+// quoted-pairs. Other values are returned as-is.
+func unquoteValue(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+
+	var sb strings.Builder
+	escaped := false
+	for _, ch := range s {
+		if !escaped && ch == '\\' {
+			escaped = true
+			continue
+		}
+		escaped = false
+		sb.WriteRune(ch)
+	}
+	return sb.String()
+}
+
+// splitResults splits a header field value on semicolons, ignoring those in
+// comments and quoted strings.
+func splitResults(s string) []string {
+	var parts []string
+	depth := 0
+	quoted, escaped := false, false
+	start := 0
+	for i, ch := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case ch == '\\' && (quoted || depth > 0):
+			escaped = true
+		case ch == '"' && depth == 0:
+			quoted = !quoted
+		case ch == '(' && !quoted:
+			depth++
+		case ch == ')' && !quoted && depth > 0:
+			depth--
+		case ch == ';' && !quoted && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// tokenize splits a result into whitespace-separated tokens. Comments are
+// removed. The comment following the first token, if any, is returned.
+func tokenize(s string) (tokens []string, comment string) {
+	var token, c strings.Builder
+	depth := 0
+	quoted, escaped := false, false
+	hasComment := false
+
+	flush := func() {
+		if token.Len() > 0 {
+			tokens = append(tokens, token.String())
+			token.Reset()
+		}
+	}
+
+	for _, ch := range s {
+		switch {
+		case depth > 0:
+			switch {
+			case escaped:
+				escaped = false
+			case ch == '\\':
+				escaped = true
+				continue
+			case ch == '(':
+				depth++
+			case ch == ')':
+				depth--
+				if depth == 0 {
+					if len(tokens) == 1 && !hasComment {
+						comment = strings.TrimSpace(c.String())
+						hasComment = true
+					}
+					c.Reset()
+					continue
+				}
+			}
+			c.WriteRune(ch)
+		case escaped:
+			escaped = false
+			token.WriteRune(ch)
+		case quoted:
+			if ch == '\\' {
+				escaped = true
+			} else if ch == '"' {
+				quoted = false
+			}
+			token.WriteRune(ch)
+		case ch == '"':
+			quoted = true
+			token.WriteRune(ch)
+		case ch == '(':
+			flush()
+			depth++
+		case unicode.IsSpace(ch):
+			flush()
+		default:
+			token.WriteRune(ch)
+		}
+	}
+	flush()
+	return tokens, comment
+}
+
+func setResultComment(r Result, comment string) {
+	switch r := r.(type) {
+	case *ARCResult:
+		r.Comment = comment
+	case *AuthResult:
+		r.Comment = comment
+	case *DKIMResult:
+		r.Comment = comment
+	case *DomainKeysResult:
+		r.Comment = comment
+	case *IPRevResult:
+		r.Comment = comment
+	case *SenderIDResult:
+		r.Comment = comment
+	case *SPFResult:
+		r.Comment = comment
+	case *DMARCResult:
+		r.Comment = comment
+	case *GenericResult:
+		r.Comment = comment
+	}
 }
@@ -11,6 +11,26 @@ var parseTests = []msgauthTest{
 		identifier: "",
 		results:    nil,
 	},
+	{
+		value:      ";",
+		identifier: "",
+		results:    nil,
+	},
+	{
+		value:      ";;",
+		identifier: "",
+		results:    nil,
+	},
+	{
+		value:      "   ",
+		identifier: "",
+		results:    nil,
+	},
+	{
+		value:      " ( ) ; ; ",
+		identifier: "",
+		results:    nil,
+	},
 	{
 		value:      "example.com 1; none",
 		identifier: "example.com",
@@ -29,9 +49,84 @@ var parseTests = []msgauthTest{
 			" auth=pass (cram-md5) smtp.auth=sender@example.com;",
 		identifier: "example.com",
 		results: []Result{
-			&AuthResult{Value: ResultPass, Auth: "sender@example.com"},
+			&AuthResult{Value: ResultPass, Comment: "cram-md5", Auth: "sender@example.com"},
 		},
 	},
+	{
+		value: "clochette.example.org;" +
+			" spf=pass smtp.mailfrom=sender@example.net;" +
+			" dkim=fail (512-bit key; too short) header.i=@d1.example;" +
+			" dkim=pass (1024-bit key) header.i=@d2.example",
+		identifier: "clochette.example.org",
+		results: []Result{
+			&SPFResult{Value: ResultPass, From: "sender@example.net"},
+			&DKIMResult{Value: ResultFail, Comment: "512-bit key; too short", Identifier: "@d1.example"},
+			&DKIMResult{Value: ResultPass, Comment: "1024-bit key", Identifier: "@d2.example"},
+		},
+	},
+	{
+		value:      "example.com (mail server) 1; dkim=pass(good=sig) header.d=example.org (extra)",
+		identifier: "example.com",
+		results: []Result{
+			&DKIMResult{Value: ResultPass, Comment: "good=sig", Domain: "example.org"},
+		},
+	},
+	{
+		value: "example.com (a (nested) comment; with) 1;" +
+			" spf=pass (outer (inner) header.from=evil.example) smtp.mailfrom=example.net (x (y) z)",
+		identifier: "example.com",
+		results: []Result{
+			&SPFResult{Value: ResultPass, Comment: "outer (inner) header.from=evil.example", From: "example.net"},
+		},
+	},
+	{
+		value:      `"example.com" 1; dkim=pass !x=y header.d=example.org`,
+		identifier: "example.com",
+		results: []Result{
+			&DKIMResult{Value: ResultPass, Domain: "example.org"},
+		},
+	},
+	{
+		value:      "example.com; ; spf=pass smtp.mailfrom=example.net;",
+		identifier: "example.com",
+		results: []Result{
+			&SPFResult{Value: ResultPass, From: "example.net"},
+		},
+	},
+	{
+		value: "example.com;; spf=pass smtp.mailfrom=example.net;;" +
+			" dkim=pass header.d=example.org; ;",
+		identifier: "example.com",
+		results: []Result{
+			&SPFResult{Value: ResultPass, From: "example.net"},
+			&DKIMResult{Value: ResultPass, Domain: "example.org"},
+		},
+	},
+	{
+		value:      "example.com; =pass; dkim=; dk!m=pass; dkim=pass header.d=example.org",
+		identifier: "example.com",
+		results: []Result{
+			&DKIMResult{Value: ResultPass, Domain: "example.org"},
+		},
+	},
+	{
+		value:      "example.com 1;;; dkim=pass header.d=example.org",
+		identifier: "example.com",
+		results: []Result{
+			&DKIMResult{Value: ResultPass, Domain: "example.org"},
+		},
+	},
+}
+
+func TestParse_invalid(t *testing.T) {
+	for _, value := range []string{
+		"example.com 2; none",
+		"example.com; dkim=p;ass",
+	} {
+		if _, _, err := Parse(value); err == nil {
+			t.Errorf("Parse(%q): expected an error", value)
+		}
+	}
 }
 
 func TestParse(t *testing.T) {
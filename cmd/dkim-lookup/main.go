@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/rsa"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+func main() {
+	flag.Parse()
+
+	selector, domain := flag.Arg(0), flag.Arg(1)
+	if selector == "" || domain == "" {
+		log.Fatal("usage: dkim-lookup <selector> <domain>")
+	}
+
+	if err := lookup(os.Stdout, selector, domain, nil); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func lookup(w io.Writer, selector, domain string, lookupTXT func(domain string) ([]string, error)) error {
+	pub, err := dkim.QueryPublicKey(domain, selector, lookupTXT)
+	if err != nil {
+		return err
+	}
+
+	size := 256 // Ed25519
+	if rsaPub, ok := pub.Key.(*rsa.PublicKey); ok {
+		size = rsaPub.N.BitLen()
+	}
+
+	fmt.Fprintf(w, "Key type: %v\n", pub.KeyAlgo)
+	fmt.Fprintf(w, "Key size: %v bits\n", size)
+	fmt.Fprintf(w, "Hash algorithms: %v\n", formatList(pub.HashAlgos))
+	fmt.Fprintf(w, "Services: %v\n", formatList(pub.Services))
+
+	var testing, strict bool
+	for _, f := range pub.Flags {
+		switch f {
+		case "y":
+			testing = true
+		case "s":
+			strict = true
+		}
+	}
+	fmt.Fprintf(w, "Testing: %v\n", testing)
+	fmt.Fprintf(w, "Strict identity: %v\n", strict)
+
+	if pub.Notes != "" {
+		fmt.Fprintf(w, "Notes: %v\n", pub.Notes)
+	}
+	return nil
+}
+
+func formatList(l []string) string {
+	if l == nil {
+		return "any"
+	}
+	return strings.Join(l, ", ")
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const testKeyRecord = "v=DKIM1; k=ed25519; h=sha256; t=y; n=test key; " +
+	"p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+
+func TestLookup(t *testing.T) {
+	lookupTXT := func(domain string) ([]string, error) {
+		if domain != "brisbane._domainkey.football.example.com" {
+			return nil, fmt.Errorf("unexpected DNS lookup for %v", domain)
+		}
+		return []string{testKeyRecord}, nil
+	}
+
+	var sb strings.Builder
+	if err := lookup(&sb, "brisbane", "football.example.com", lookupTXT); err != nil {
+		t.Fatalf("lookup() = %v", err)
+	}
+
+	want := "Key type: ed25519\n" +
+		"Key size: 256 bits\n" +
+		"Hash algorithms: sha256\n" +
+		"Services: any\n" +
+		"Testing: true\n" +
+		"Strict identity: false\n" +
+		"Notes: test key\n"
+	if s := sb.String(); s != want {
+		t.Errorf("lookup() output = \n%v\n want \n%v", s, want)
+	}
+}
@@ -3,8 +3,6 @@ package main
 import (
 	"bytes"
 	"crypto"
-	"crypto/x509"
-	"encoding/pem"
 	"flag"
 	"fmt"
 	"io"
@@ -22,7 +20,6 @@ import (
 	"github.com/emersion/go-milter"
 	"github.com/emersion/go-msgauth/authres"
 	"github.com/emersion/go-msgauth/dkim"
-	"golang.org/x/crypto/ed25519"
 )
 
 var (
@@ -299,9 +296,7 @@ func (s *session) Body(m *milter.Modifier) (milter.Response, error) {
 	results := make([]authres.Result, 0, len(s.verifs))
 
 	if len(s.verifs) == 0 && s.signer == nil {
-		results = append(results, &authres.DKIMResult{
-			Value: authres.ResultNone,
-		})
+		results = append(results, dkim.NoSignatureResult())
 	}
 
 	for _, verif := range s.verifs {
@@ -313,22 +308,7 @@ func (s *session) Body(m *milter.Modifier) (milter.Response, error) {
 			}
 		}
 
-		var val authres.ResultValue
-		if verif.Err == nil {
-			val = authres.ResultPass
-		} else if dkim.IsPermFail(verif.Err) {
-			val = authres.ResultPermError
-		} else if dkim.IsTempFail(verif.Err) {
-			val = authres.ResultTempError
-		} else {
-			val = authres.ResultFail
-		}
-
-		results = append(results, &authres.DKIMResult{
-			Value:      val,
-			Domain:     verif.Domain,
-			Identifier: verif.Identifier,
-		})
+		results = append(results, verif.AuthResult(""))
 	}
 
 	if len(s.verifs) > 0 || s.signer == nil {
@@ -342,33 +322,11 @@ func (s *session) Body(m *milter.Modifier) (milter.Response, error) {
 }
 
 func loadPrivateKey(path string) (crypto.Signer, error) {
-	b, err := ioutil.ReadFile(privateKeyPath)
+	b, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-
-	block, _ := pem.Decode(b)
-	if block == nil {
-		return nil, fmt.Errorf("no PEM data found")
-	}
-
-	switch strings.ToUpper(block.Type) {
-	case "PRIVATE KEY":
-		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
-		if err != nil {
-			return nil, err
-		}
-		return k.(crypto.Signer), nil
-	case "RSA PRIVATE KEY":
-		return x509.ParsePKCS1PrivateKey(block.Bytes)
-	case "EDDSA PRIVATE KEY":
-		if len(block.Bytes) != ed25519.PrivateKeySize {
-			return nil, fmt.Errorf("invalid Ed25519 private key size")
-		}
-		return ed25519.PrivateKey(block.Bytes), nil
-	default:
-		return nil, fmt.Errorf("unknown private key type: '%v'", block.Type)
-	}
+	return dkim.ParsePrivateKey(b)
 }
 
 func main() {
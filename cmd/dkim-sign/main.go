@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+var (
+	domain           string
+	selector         string
+	privateKeyPath   string
+	canonicalization string
+)
+
+func init() {
+	flag.StringVar(&domain, "d", "", "Signing domain")
+	flag.StringVar(&selector, "s", "", "Selector")
+	flag.StringVar(&privateKeyPath, "k", "", "Private key (PEM-formatted)")
+	flag.StringVar(&canonicalization, "c", "relaxed/relaxed", "Header and body canonicalization (simple, relaxed)")
+}
+
+func loadPrivateKey(path string) (crypto.Signer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return dkim.ParsePrivateKey(b)
+}
+
+// parseCanonicalization parses a "c=" tag-like value. If only the header
+// canonicalization is specified, the body canonicalization defaults to
+// simple.
+func parseCanonicalization(s string) (headerCan, bodyCan dkim.Canonicalization, err error) {
+	h, b, ok := strings.Cut(s, "/")
+	if !ok {
+		b = string(dkim.CanonicalizationSimple)
+	}
+	for _, c := range []string{h, b} {
+		switch dkim.Canonicalization(c) {
+		case dkim.CanonicalizationSimple, dkim.CanonicalizationRelaxed:
+		default:
+			return "", "", fmt.Errorf("unknown canonicalization %q", c)
+		}
+	}
+	return dkim.Canonicalization(h), dkim.Canonicalization(b), nil
+}
+
+func newSignOptions(domain, selector, privateKeyPath, canonicalization string) (*dkim.SignOptions, error) {
+	signer, err := loadPrivateKey(privateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load private key: %v", err)
+	}
+
+	headerCan, bodyCan, err := parseCanonicalization(canonicalization)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dkim.SignOptions{
+		Domain:                 domain,
+		Selector:               selector,
+		Signer:                 signer,
+		HeaderCanonicalization: headerCan,
+		BodyCanonicalization:   bodyCan,
+	}, nil
+}
+
+func main() {
+	flag.Parse()
+
+	if domain == "" || selector == "" || privateKeyPath == "" {
+		log.Fatal("Domain (-d), private key (-k) and selector (-s) must all be specified")
+	}
+
+	options, err := newSignOptions(domain, selector, privateKeyPath, canonicalization)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := dkim.Sign(os.Stdout, os.Stdin, options); err != nil {
+		log.Fatal("Failed to sign message: ", err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+const testMessage = "From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game. Are you hungry yet?\r\n"
+
+func TestSignAndVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name             string
+		key              interface{}
+		pub              interface{}
+		keyType          string
+		canonicalization string
+	}{
+		{"rsa", rsaKey, &rsaKey.PublicKey, "rsa", "relaxed/relaxed"},
+		{"ed25519", edKey, edKey.Public(), "ed25519", "simple/relaxed"},
+		{"relaxed", edKey, edKey.Public(), "ed25519", "relaxed"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			der, err := x509.MarshalPKCS8PrivateKey(test.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keyPath := filepath.Join(t.TempDir(), "dkim.priv")
+			b := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+			if err := os.WriteFile(keyPath, b, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			var pubBytes []byte
+			switch pub := test.pub.(type) {
+			case ed25519.PublicKey:
+				pubBytes = pub
+			default:
+				pubBytes, err = x509.MarshalPKIXPublicKey(pub)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			record := fmt.Sprintf("v=DKIM1; k=%v; p=%v", test.keyType, base64.StdEncoding.EncodeToString(pubBytes))
+
+			options, err := newSignOptions("example.org", "test", keyPath, test.canonicalization)
+			if err != nil {
+				t.Fatalf("newSignOptions() = %v", err)
+			}
+
+			var signed bytes.Buffer
+			if err := dkim.Sign(&signed, strings.NewReader(testMessage), options); err != nil {
+				t.Fatalf("Sign() = %v", err)
+			}
+
+			verifOptions := &dkim.VerifyOptions{
+				LookupTXT: func(domain string) ([]string, error) {
+					if domain != "test._domainkey.example.org" {
+						return nil, fmt.Errorf("unexpected DNS lookup for %v", domain)
+					}
+					return []string{record}, nil
+				},
+			}
+			verifications, err := dkim.VerifyWithOptions(&signed, verifOptions)
+			if err != nil {
+				t.Fatalf("VerifyWithOptions() = %v", err)
+			} else if len(verifications) != 1 {
+				t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+			} else if err := verifications[0].Err; err != nil {
+				t.Errorf("Expected no error while verifying signature, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseCanonicalization(t *testing.T) {
+	if _, _, err := parseCanonicalization("relaxed/loose"); err == nil {
+		t.Errorf("Expected an error for an unknown canonicalization")
+	}
+	h, b, err := parseCanonicalization("relaxed")
+	if err != nil {
+		t.Fatalf("parseCanonicalization() = %v", err)
+	}
+	if h != dkim.CanonicalizationRelaxed || b != dkim.CanonicalizationSimple {
+		t.Errorf("parseCanonicalization(%q) = %v/%v, want relaxed/simple", "relaxed", h, b)
+	}
+}
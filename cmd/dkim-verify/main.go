@@ -1,23 +1,38 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"log"
 	"os"
 
 	"github.com/emersion/go-msgauth/dkim"
 )
 
+var jsonOutput bool
+
+func init() {
+	flag.BoolVar(&jsonOutput, "json", false, "print verifications as JSON")
+}
+
 func main() {
+	flag.Parse()
+
 	verifications, err := dkim.Verify(os.Stdin)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	for _, v := range verifications {
-		if v.Err == nil {
-			log.Printf("Valid signature for %v", v.Domain)
-		} else {
-			log.Printf("Invalid signature for %v: %v", v.Domain, v.Err)
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(verifications); err != nil {
+			log.Fatal(err)
 		}
+		return
+	}
+
+	for _, v := range verifications {
+		log.Println(v)
 	}
 }
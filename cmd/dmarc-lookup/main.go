@@ -1,24 +1,66 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"log"
+	"net"
+	"os"
 
 	"github.com/emersion/go-msgauth/dmarc"
 )
 
+var jsonOutput bool
+
+func init() {
+	flag.BoolVar(&jsonOutput, "json", false, "print the DMARC record as JSON")
+}
+
 func main() {
 	flag.Parse()
 
 	domain := flag.Arg(0)
 	if domain == "" {
-		log.Fatal("usage: dmarc-lookup <domain>")
+		log.Fatal("usage: dmarc-lookup [-json] <domain>")
 	}
 
-	rec, err := dmarc.Lookup(domain)
+	rec, selected, txts, err := lookup(domain, net.LookupTXT)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if len(txts) > 1 {
+		log.Printf("Selected record %q out of %v TXT records", selected, len(txts))
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(rec); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	log.Printf("%#v\n", rec)
 }
+
+// lookup looks up the DMARC record of a domain. It also returns the TXT
+// record the DMARC record was parsed from, and all TXT records found.
+func lookup(domain string, lookupTXT func(domain string) ([]string, error)) (rec *dmarc.Record, selected string, txts []string, err error) {
+	rec, err = dmarc.LookupWithOptions(domain, &dmarc.LookupOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			var err error
+			txts, err = lookupTXT(domain)
+			return txts, err
+		},
+	})
+	if err != nil {
+		return nil, "", txts, err
+	}
+
+	selected, err = dmarc.SelectRecord(txts)
+	if err != nil {
+		return nil, "", txts, err
+	}
+	return rec, selected, txts, nil
+}
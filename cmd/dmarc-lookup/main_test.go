@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dmarc"
+)
+
+func TestLookup(t *testing.T) {
+	txts := []string{
+		"v=spf1 -all",
+		// Parses, but doesn't start with a "v=DMARC1" tag
+		"p=none; v=DMARC1",
+		"v=DMARC1; p=reject; adkim=s",
+		"google-site-verification=abc",
+	}
+	lookupTXT := func(domain string) ([]string, error) {
+		if domain != "_dmarc.example.org" {
+			return nil, fmt.Errorf("unexpected DNS lookup for %v", domain)
+		}
+		return txts, nil
+	}
+
+	rec, selected, got, err := lookup("example.org", lookupTXT)
+	if err != nil {
+		t.Fatalf("lookup() = %v", err)
+	}
+	if want := txts[2]; selected != want {
+		t.Errorf("lookup() selected record %q, want %q", selected, want)
+	}
+	if len(got) != len(txts) {
+		t.Errorf("lookup() returned %v TXT records, want %v", len(got), len(txts))
+	}
+	if rec.Policy != dmarc.PolicyReject || rec.DKIMAlignment != dmarc.AlignmentStrict {
+		t.Errorf("lookup() returned record %+v", rec)
+	}
+}
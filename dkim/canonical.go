@@ -1,6 +1,9 @@
 package dkim
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
 	"io"
 	"strings"
 )
@@ -52,50 +55,85 @@ func (c *simpleCanonicalizer) CanonicalizeHeader(s string) string {
 	return s
 }
 
+// crlfRun keeps track of a run of CRLF sequences which may need to be written
+// later on. Only the number of sequences is kept, so that long runs of empty
+// lines don't make the canonicalizer buffer an unbounded amount of data.
+type crlfRun struct {
+	n  int  // number of pending CRLF sequences
+	cr bool // whether the last byte was a CR
+}
+
+// flush appends the pending CRLF sequences to buf. If buf grows large, it's
+// written to w.
+func (run *crlfRun) flush(w io.Writer, buf []byte) ([]byte, error) {
+	for ; run.n > 0; run.n-- {
+		if len(buf) >= 4096 {
+			if _, err := w.Write(buf); err != nil {
+				return buf, err
+			}
+			buf = buf[:0]
+		}
+		buf = append(buf, crlf...)
+	}
+	return buf, nil
+}
+
 type simpleBodyCanonicalizer struct {
 	w         io.Writer
-	crlfBuf   []byte
+	run       crlfRun
 	crlfFixer crlfFixer
 }
 
 func (c *simpleBodyCanonicalizer) Write(b []byte) (int, error) {
 	written := len(b)
-	b = append(c.crlfBuf, b...)
-
 	b = c.crlfFixer.Fix(b)
 
-	end := len(b)
-	// If it ends with \r, maybe the next write will begin with \n
-	if end > 0 && b[end-1] == '\r' {
-		end--
-	}
-	// Keep all \r\n sequences
-	for end >= 2 {
-		prev := b[end-2]
-		cur := b[end-1]
-		if prev != '\r' || cur != '\n' {
-			break
+	canonical := make([]byte, 0, len(b))
+	var err error
+	for _, ch := range b {
+		if c.run.cr {
+			c.run.cr = false
+			if ch == '\n' {
+				c.run.n++
+				continue
+			}
+			// Lone CR
+			if canonical, err = c.run.flush(c.w, canonical); err != nil {
+				return written, err
+			}
+			canonical = append(canonical, '\r')
 		}
-		end -= 2
-	}
 
-	c.crlfBuf = b[end:]
+		if ch == '\r' {
+			c.run.cr = true
+			continue
+		}
 
-	var err error
-	if end > 0 {
-		_, err = c.w.Write(b[:end])
+		if canonical, err = c.run.flush(c.w, canonical); err != nil {
+			return written, err
+		}
+		canonical = append(canonical, ch)
+	}
+
+	if len(canonical) > 0 {
+		_, err = c.w.Write(canonical)
 	}
 	return written, err
 }
 
 func (c *simpleBodyCanonicalizer) Close() error {
-	// Flush crlfBuf if it ends with a single \r (without a matching \n)
-	if len(c.crlfBuf) > 0 && c.crlfBuf[len(c.crlfBuf)-1] == '\r' {
-		if _, err := c.w.Write(c.crlfBuf); err != nil {
+	// Flush the pending CRLF sequences if they're followed by a single \r
+	// (without a matching \n)
+	if c.run.cr {
+		buf, err := c.run.flush(c.w, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := c.w.Write(append(buf, '\r')); err != nil {
 			return err
 		}
 	}
-	c.crlfBuf = nil
+	c.run = crlfRun{}
 
 	if _, err := c.w.Write([]byte(crlf)); err != nil {
 		return err
@@ -123,9 +161,13 @@ func (c *relaxedCanonicalizer) CanonicalizeHeader(s string) string {
 }
 
 type relaxedBodyCanonicalizer struct {
-	w         io.Writer
-	crlfBuf   []byte
-	wsp       bool
+	w   io.Writer
+	run crlfRun
+	// The number of CRLF sequences preceding each pending lone CR. Lone CRs
+	// are kept in the pending run: like CRLF sequences, they're dropped at
+	// the end of the body.
+	lone      []int
+	wsp       bool // whether a run of WSP is pending, collapsed to a single SP
 	written   bool
 	crlfFixer crlfFixer
 }
@@ -136,35 +178,62 @@ func (c *relaxedBodyCanonicalizer) Write(b []byte) (int, error) {
 	b = c.crlfFixer.Fix(b)
 
 	canonical := make([]byte, 0, len(b))
+	var err error
 	for _, ch := range b {
-		if ch == ' ' || ch == '\t' {
+		if c.run.cr {
+			c.run.cr = false
+			if ch == '\n' {
+				c.run.n++
+				continue
+			}
+			// Lone CR, not a line ending
+			c.lone = append(c.lone, c.run.n)
+			c.run.n = 0
+		}
+
+		switch ch {
+		case ' ', '\t':
 			c.wsp = true
-		} else if ch == '\r' || ch == '\n' {
+		case '\r':
 			c.wsp = false
-			c.crlfBuf = append(c.crlfBuf, ch)
-		} else {
-			if len(c.crlfBuf) > 0 {
-				canonical = append(canonical, c.crlfBuf...)
-				c.crlfBuf = c.crlfBuf[:0]
+			c.run.cr = true
+		default:
+			if canonical, err = c.flush(canonical); err != nil {
+				return written, err
 			}
 			if c.wsp {
 				canonical = append(canonical, ' ')
 				c.wsp = false
 			}
-
 			canonical = append(canonical, ch)
+			c.written = true
 		}
 	}
 
-	if !c.written && len(canonical) > 0 {
-		c.written = true
+	if len(canonical) > 0 {
+		_, err = c.w.Write(canonical)
 	}
-
-	_, err := c.w.Write(canonical)
 	return written, err
 }
 
+// flush appends the pending lone CRs and CRLF sequences to buf.
+func (c *relaxedBodyCanonicalizer) flush(buf []byte) ([]byte, error) {
+	var err error
+	for _, n := range c.lone {
+		run := crlfRun{n: n}
+		if buf, err = run.flush(c.w, buf); err != nil {
+			return buf, err
+		}
+		buf = append(buf, '\r')
+	}
+	c.lone = c.lone[:0]
+	return c.run.flush(c.w, buf)
+}
+
 func (c *relaxedBodyCanonicalizer) Close() error {
+	// Pending line endings and lone CRs at the end of the body are dropped
+	c.run = crlfRun{}
+	c.lone = nil
 	if c.written {
 		if _, err := c.w.Write([]byte(crlf)); err != nil {
 			return err
@@ -177,6 +246,50 @@ func (c *relaxedCanonicalizer) CanonicalizeBody(w io.Writer) io.WriteCloser {
 	return &relaxedBodyCanonicalizer{w: w}
 }
 
+// CanonicalizeMessage canonicalizes a message, and returns the bytes that
+// are hashed when signing or verifying it: the canonicalized header fields
+// listed in headerKeys and the canonicalized body. The DKIM-Signature header
+// field itself isn't included.
+//
+// This is useful to debug interoperability issues.
+func CanonicalizeMessage(r io.Reader, headerKeys []string, headerCan, bodyCan Canonicalization) (canonHeaders, canonBody []byte, err error) {
+	hc, ok := canonicalizers[headerCan]
+	if !ok {
+		return nil, nil, fmt.Errorf("dkim: unknown header canonicalization %q", headerCan)
+	}
+	bc, ok := canonicalizers[bodyCan]
+	if !ok {
+		return nil, nil, fmt.Errorf("dkim: unknown body canonicalization %q", bodyCan)
+	}
+
+	br := bufio.NewReader(r)
+	h, err := readHeader(br)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var hb bytes.Buffer
+	picker := newHeaderPicker(h)
+	for _, k := range headerKeys {
+		kv := picker.Pick(k)
+		if kv == "" {
+			continue
+		}
+		hb.WriteString(hc.CanonicalizeHeader(kv))
+	}
+
+	var bb bytes.Buffer
+	wc := bc.CanonicalizeBody(&bb)
+	if _, err := io.Copy(wc, br); err != nil {
+		return nil, nil, err
+	}
+	if err := wc.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	return hb.Bytes(), bb.Bytes(), nil
+}
+
 type limitedWriter struct {
 	W io.Writer
 	N int64
@@ -189,8 +302,8 @@ func (w *limitedWriter) Write(b []byte) (int, error) {
 
 	skipped := 0
 	if int64(len(b)) > w.N {
+		skipped = len(b) - int(w.N)
 		b = b[:w.N]
-		skipped = int(int64(len(b)) - w.N)
 	}
 
 	n, err := w.W.Write(b)
@@ -2,6 +2,8 @@ package dkim
 
 import (
 	"bytes"
+	"io"
+	"strings"
 	"testing"
 )
 
@@ -49,6 +51,18 @@ var simpleCanonicalizerBodyTests = []struct {
 		[]string{"\r\n", "\r", "\n", "hey\n", "\n"},
 		"\r\n\r\nhey\r\n",
 	},
+	{
+		[]string{"\r", "\n"},
+		"\r\n",
+	},
+	{
+		[]string{"\r", "\n", "\r", "\n"},
+		"\r\n",
+	},
+	{
+		[]string{"\n"},
+		"\r\n",
+	},
 }
 
 func TestSimpleCanonicalizer_CanonicalBody(t *testing.T) {
@@ -73,6 +87,24 @@ func TestSimpleCanonicalizer_CanonicalBody(t *testing.T) {
 	}
 }
 
+func TestSimpleCanonicalizer_CanonicalBody_splitCRLF(t *testing.T) {
+	var b bytes.Buffer
+	wc := new(simpleCanonicalizer).CanonicalizeBody(&b)
+	for _, chunk := range []string{"\r", "\n"} {
+		if _, err := io.WriteString(wc, chunk); err != nil {
+			t.Fatalf("Expected no error while writing to simple body canonicalizer, got: %v", err)
+		}
+		if b.Len() != 0 {
+			t.Errorf("Expected nothing to be written before the end of the body, got %q", b.String())
+		}
+	}
+	if err := wc.Close(); err != nil {
+		t.Fatalf("Expected no error while closing simple body canonicalizer, got: %v", err)
+	} else if s := b.String(); s != "\r\n" {
+		t.Errorf("Expected canonical body to be a single CRLF, but got %q", s)
+	}
+}
+
 var relaxedCanonicalizerHeaderTests = []struct {
 	original  string
 	canonical string
@@ -81,6 +113,14 @@ var relaxedCanonicalizerHeaderTests = []struct {
 		"SubjeCT: Your Name\r\n",
 		"subject:Your Name\r\n",
 	},
+	{
+		"Subject: MixedCase Value\r\n",
+		"subject:MixedCase Value\r\n",
+	},
+	{
+		"DKIM-Signature: v=1; d=Example.ORG; s=Brisbane\r\n",
+		"dkim-signature:v=1; d=Example.ORG; s=Brisbane\r\n",
+	},
 	{
 		"Subject \t:\t Your Name\t \r\n",
 		"subject:Your Name\r\n",
@@ -93,6 +133,12 @@ var relaxedCanonicalizerHeaderTests = []struct {
 		"Subject \t:\t Ki \tmi \t \r\n No \t\r\n Na Wa\r\n",
 		"subject:Ki mi No Na Wa\r\n",
 	},
+	{
+		// Whitespace inside a malformed field name is kept, so that the field
+		// doesn't match any signed field name
+		"Sub ject : x\r\n",
+		"sub ject:x\r\n",
+	},
 }
 
 func TestRelaxedCanonicalizer_CanonicalizeHeader(t *testing.T) {
@@ -149,6 +195,10 @@ var relaxedCanonicalizerBodyTests = []struct {
 		"Hey\r\n \t \r\n \r\n",
 		"Hey\r\n",
 	},
+	{
+		"Hey \t\rthere\r\n",
+		"Hey\rthere\r\n",
+	},
 }
 
 func TestRelaxedCanonicalizer_CanonicalBody(t *testing.T) {
@@ -189,3 +239,214 @@ func TestRelaxedCanonicalizer_CanonicalBody_splitCRLF(t *testing.T) {
 		t.Errorf("Expected canonical body to be %q, but got %q", want, s)
 	}
 }
+
+// Lone CRs are kept with the pending line endings: they're only written if
+// followed by other content, and dropped at the end of the body.
+func TestRelaxedCanonicalizer_CanonicalBody_loneCR(t *testing.T) {
+	tests := []struct {
+		original  string
+		canonical string
+	}{
+		{"\r", ""},
+		{"a\r", "a\r\n"},
+		{"a\r\n\r", "a\r\n"},
+		{"    \r\t \t\n", ""},
+		{"a \r\r\t\t", "a\r\n"},
+		{"a\r b", "a\r b\r\n"},
+		{"a\r\n\r\r\n\rb", "a\r\n\r\r\n\rb\r\n"},
+		{"a\r\n\r\n\r\r\nb\r\n\r", "a\r\n\r\n\r\r\nb\r\n"},
+	}
+
+	canonicalize := func(writes []string) (string, error) {
+		var b bytes.Buffer
+		wc := new(relaxedCanonicalizer).CanonicalizeBody(&b)
+		for _, s := range writes {
+			if _, err := wc.Write([]byte(s)); err != nil {
+				return "", err
+			}
+		}
+		err := wc.Close()
+		return b.String(), err
+	}
+
+	for _, test := range tests {
+		// In a single write, then split at every position
+		splits := [][]string{{test.original}}
+		for i := 1; i < len(test.original); i++ {
+			splits = append(splits, []string{test.original[:i], test.original[i:]})
+		}
+		var bytewise []string
+		for i := range test.original {
+			bytewise = append(bytewise, test.original[i:i+1])
+		}
+		splits = append(splits, bytewise)
+
+		for _, writes := range splits {
+			if s, err := canonicalize(writes); err != nil {
+				t.Errorf("Expected no error while canonicalizing %q, got: %v", writes, err)
+			} else if s != test.canonical {
+				t.Errorf("Expected canonical body for %q to be %q, but got %q", writes, test.canonical, s)
+			}
+		}
+	}
+}
+
+// Example from RFC 6376 section 3.4.5
+const canonicalizationMessage = "A: X\r\n" +
+	"B : Y\t\r\n" +
+	"\tZ  \r\n" +
+	"\r\n" +
+	" C \r\n" +
+	"D \t E\r\n" +
+	"\r\n" +
+	"\r\n"
+
+func TestCanonicalizeMessage(t *testing.T) {
+	tests := []struct {
+		can     Canonicalization
+		headers string
+		body    string
+	}{
+		{
+			CanonicalizationRelaxed,
+			"a:X\r\n" +
+				"b:Y Z\r\n",
+			" C\r\n" +
+				"D E\r\n",
+		},
+		{
+			CanonicalizationSimple,
+			"A: X\r\n" +
+				"B : Y\t\r\n" +
+				"\tZ  \r\n",
+			" C \r\n" +
+				"D \t E\r\n",
+		},
+	}
+
+	for _, test := range tests {
+		r := strings.NewReader(canonicalizationMessage)
+		headers, body, err := CanonicalizeMessage(r, []string{"A", "B"}, test.can, test.can)
+		if err != nil {
+			t.Fatalf("Expected no error while canonicalizing message with %v canonicalization, got: %v", test.can, err)
+		}
+		if string(headers) != test.headers {
+			t.Errorf("Expected %v canonical header to be %q, but got %q", test.can, test.headers, headers)
+		}
+		if string(body) != test.body {
+			t.Errorf("Expected %v canonical body to be %q, but got %q", test.can, test.body, body)
+		}
+	}
+}
+
+func TestBodyCanonicalizer_largeBody(t *testing.T) {
+	// A multi-megabyte base64 body, followed by a long run of empty lines
+	var body bytes.Buffer
+	line := strings.Repeat("QUJDREVGR0hJSktMTU5PUFFSU1RVVldYWVphYmNkZWZnaGlqa2xtbm9wcXJzdHV2d3h5", 2)[:76]
+	for body.Len() < 4<<20 {
+		body.WriteString(line + "\r\n")
+	}
+	emptyLines := strings.Repeat("\r\n", 1<<20)
+	want := body.String()
+
+	for name, c := range canonicalizers {
+		t.Run(string(name), func(t *testing.T) {
+			var b bytes.Buffer
+			wc := c.CanonicalizeBody(&b)
+
+			r := io.MultiReader(bytes.NewReader(body.Bytes()), strings.NewReader(emptyLines))
+			if _, err := io.CopyBuffer(wc, r, make([]byte, 32*1024)); err != nil {
+				t.Fatalf("Expected no error while writing body, got: %v", err)
+			}
+
+			// The trailing empty lines must not be buffered
+			switch wc := wc.(type) {
+			case *simpleBodyCanonicalizer:
+				if wc.run.n != 1<<20+1 {
+					t.Errorf("Expected %v pending CRLF sequences, got %v", 1<<20+1, wc.run.n)
+				}
+			case *relaxedBodyCanonicalizer:
+				if wc.run.n != 1<<20+1 {
+					t.Errorf("Expected %v pending CRLF sequences, got %v", 1<<20+1, wc.run.n)
+				}
+			}
+
+			if err := wc.Close(); err != nil {
+				t.Fatalf("Expected no error while closing body canonicalizer, got: %v", err)
+			}
+			if b.Len() != len(want) {
+				t.Fatalf("Expected canonical body to be %v bytes long, got %v", len(want), b.Len())
+			} else if b.String() != want {
+				t.Errorf("Canonical body doesn't match the original base64 body")
+			}
+		})
+	}
+}
+
+func TestBodyCanonicalizer_longCRLFRun(t *testing.T) {
+	const n = 1 << 20
+	want := "a\r\n" + strings.Repeat("\r\n", n) + "b\r\n"
+
+	for name, c := range canonicalizers {
+		t.Run(string(name), func(t *testing.T) {
+			var b bytes.Buffer
+			wc := c.CanonicalizeBody(&b)
+			if _, err := io.WriteString(wc, "a"); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < n+1; i++ {
+				if _, err := io.WriteString(wc, "\r\n"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := io.WriteString(wc, "b"); err != nil {
+				t.Fatal(err)
+			}
+			if err := wc.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != want {
+				t.Errorf("Expected canonical body to be %v bytes long, got %v", len(want), b.Len())
+			}
+		})
+	}
+}
+
+func TestRelaxedCanonicalizer_CanonicalBody_longWhitespaceRun(t *testing.T) {
+	var b bytes.Buffer
+	wc := new(relaxedCanonicalizer).CanonicalizeBody(&b)
+	if _, err := io.WriteString(wc, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	chunk := []byte(strings.Repeat(" \t", 16*1024))
+	for i := 0; i < 256; i++ {
+		if _, err := wc.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The whitespace run is collapsed as it's read, nothing is kept around
+	if s := b.String(); s != "a" {
+		t.Errorf("Expected only %q to be written before the end of the whitespace run, got %q", "a", s)
+	}
+
+	if _, err := io.WriteString(wc, "b\r\nc"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 256; i++ {
+		if _, err := wc.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := io.WriteString(wc, "\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := wc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "a b\r\nc\r\n"
+	if s := b.String(); s != want {
+		t.Errorf("Expected canonical body to be %q, but got %q", want, s)
+	}
+}
@@ -5,7 +5,8 @@
 // Why can't I verify a [net/mail.Message] directly? A [net/mail.Message]
 // header is already parsed, and whitespace characters (especially continuation
 // lines) are removed. Thus, the signature computed from the parsed header is
-// not the same as the one computed from the raw header.
+// not the same as the one computed from the raw header. [VerifyMessage] can
+// still verify signatures using the relaxed header canonicalization.
 //
 // How can I publish my public key? You have to add a TXT record to your DNS
 // zone. See [RFC 6376 appendix C]. You can use the dkim-keygen tool included
@@ -0,0 +1,39 @@
+package dkim
+
+import (
+	"strings"
+	"testing"
+)
+
+func FuzzParseSignature(f *testing.F) {
+	f.Add(testVerification.Signature)
+	f.Add(testRawRSAVerification.Signature)
+	f.Add(testEd25519Verification.Signature)
+	f.Add("v=1; a=rsa-sha256; d=example.org; s=brisbane; h=From; bh=; b=")
+
+	f.Fuzz(func(t *testing.T, value string) {
+		// Verification must not panic, whatever the signature
+		Verify(strings.NewReader(headerFieldName + ": " + value + crlf + mailString))
+
+		params, err := parseHeaderParams(value)
+		if err != nil {
+			return
+		}
+
+		// Formatting may fold values, but must keep all tags
+		formatted := formatSignature(params)
+		_, v := parseHeaderField(formatted)
+		params2, err := parseHeaderParams(v)
+		if err != nil {
+			t.Fatalf("parseHeaderParams(%q) = %v", v, err)
+		}
+		if len(params2) != len(params) {
+			t.Fatalf("parseHeaderParams(%q) = %q, want %q", v, params2, params)
+		}
+		for k, v := range params {
+			if stripWhitespace(params2[k]) != stripWhitespace(v) {
+				t.Errorf("parseHeaderParams(%q)[%q] = %q, want %q", formatted, k, params2[k], v)
+			}
+		}
+	})
+}
@@ -6,24 +6,57 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"net/textproto"
 	"sort"
+	"strconv"
 	"strings"
 )
 
 const crlf = "\r\n"
 
+// ErrHeaderTooLarge is returned by Verify when the message header exceeds
+// VerifyOptions.MaxHeaderSize.
+var ErrHeaderTooLarge = errors.New("dkim: header too large")
+
 type header []string
 
 func readHeader(r *bufio.Reader) (header, error) {
-	tr := textproto.NewReader(r)
+	return readHeaderAllowEOF(r, false)
+}
+
+// readHeaderAllowEOF reads a message header. If allowEOF is true, reaching EOF
+// after a header field is accepted and the message body is considered empty.
+func readHeaderAllowEOF(r *bufio.Reader, allowEOF bool) (header, error) {
+	return readHeaderLimit(r, allowEOF, 0)
+}
+
+// readHeaderLimit reads a message header. If maxSize is positive, it fails
+// with ErrHeaderTooLarge as soon as the header exceeds maxSize bytes, without
+// buffering the rest of the offending line.
+func readHeaderLimit(r *bufio.Reader, allowEOF bool, maxSize int) (header, error) {
+	if err := skipBOM(r); err != nil {
+		return nil, fmt.Errorf("failed to read header: %v", err)
+	}
 
 	var h header
+	size := 0
 	for {
-		l, err := tr.ReadLine()
-		if err != nil {
+		maxLen := -1
+		if maxSize > 0 {
+			maxLen = maxSize - size - len(crlf)
+			if maxLen < 0 {
+				return h, ErrHeaderTooLarge
+			}
+		}
+
+		l, err := readLine(r, maxLen)
+		if err == io.EOF && allowEOF && len(h) > 0 {
+			break
+		} else if err == ErrHeaderTooLarge {
+			return h, err
+		} else if err != nil {
 			return h, fmt.Errorf("failed to read header: %v", err)
 		}
+		size += len(l) + len(crlf)
 
 		if len(l) == 0 {
 			break
@@ -38,6 +71,62 @@ func readHeader(r *bufio.Reader) (header, error) {
 	return h, nil
 }
 
+// readLine reads a line without its trailing CRLF or LF, like
+// textproto.Reader.ReadLine. If maxLen isn't negative and the line is
+// longer, ErrHeaderTooLarge is returned.
+func readLine(r *bufio.Reader, maxLen int) (string, error) {
+	var line []byte
+	for {
+		l, more, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		if maxLen >= 0 && len(line)+len(l) > maxLen {
+			return "", ErrHeaderTooLarge
+		}
+		line = append(line, l...)
+		if !more {
+			break
+		}
+	}
+	return string(line), nil
+}
+
+// utf8BOM is the UTF-8 byte order mark. Some messages erroneously start with
+// one, which isn't part of the first header field.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// skipBOM discards a UTF-8 byte order mark at the start of r, if any.
+func skipBOM(r *bufio.Reader) error {
+	if b, err := r.Peek(len(utf8BOM)); err == nil && bytes.Equal(b, utf8BOM) {
+		_, err = r.Discard(len(utf8BOM))
+		return err
+	}
+	return nil
+}
+
+// trimBOM removes a UTF-8 byte order mark at the start of b, if any.
+func trimBOM(b *bytes.Buffer) {
+	if bytes.HasPrefix(b.Bytes(), utf8BOM) {
+		b.Next(len(utf8BOM))
+	}
+}
+
+// terminateHeader appends the empty line ending the header to a raw message
+// which doesn't have a body, preceded by a CRLF if the last header field is
+// unterminated.
+func terminateHeader(b *bytes.Buffer) {
+	msg := b.Bytes()
+	if bytes.HasPrefix(msg, []byte("\n")) || bytes.HasPrefix(msg, []byte(crlf)) ||
+		bytes.Contains(msg, []byte("\n\n")) || bytes.Contains(msg, []byte("\n"+crlf)) {
+		return
+	}
+	if !bytes.HasSuffix(msg, []byte("\n")) {
+		b.WriteString(crlf)
+	}
+	b.WriteString(crlf)
+}
+
 func writeHeader(w io.Writer, h header) error {
 	for _, kv := range h {
 		if _, err := w.Write([]byte(kv)); err != nil {
@@ -145,6 +234,13 @@ func newHeaderPicker(h header) *headerPicker {
 }
 
 func (p *headerPicker) Pick(key string) string {
+	kv, _ := p.PickIndex(key)
+	return kv
+}
+
+// PickIndex is like Pick, but also returns the index of the picked header
+// field. If no header field is picked, the index is -1.
+func (p *headerPicker) PickIndex(key string) (string, int) {
 	key = strings.ToLower(key)
 
 	at := p.picked[key]
@@ -158,10 +254,51 @@ func (p *headerPicker) Pick(key string) string {
 
 		if at == 0 {
 			p.picked[key]++
-			return kv
+			return kv, i
 		}
 		at--
 	}
 
-	return ""
+	return "", -1
+}
+
+// encodeQuotedPrintable encodes a tag value with the DKIM quoted-printable
+// encoding, defined in RFC 6376 section 2.11. Only characters which aren't
+// allowed in tag values (whitespace, ";", "=" and non-ASCII characters) are
+// encoded.
+func encodeQuotedPrintable(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch > ' ' && ch < 0x7F && ch != ';' && ch != '=' {
+			sb.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&sb, "=%02X", ch)
+		}
+	}
+	return sb.String()
+}
+
+// decodeQuotedPrintable decodes a tag value encoded with the DKIM
+// quoted-printable encoding. Whitespace is ignored.
+func decodeQuotedPrintable(s string) (string, error) {
+	s = stripWhitespace(s)
+
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '=' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", errors.New("dkim: truncated quoted-printable escape")
+		}
+		b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("dkim: malformed quoted-printable escape: %v", err)
+		}
+		sb.WriteByte(byte(b))
+		i += 2
+	}
+	return sb.String(), nil
 }
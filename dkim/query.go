@@ -4,11 +4,11 @@ import (
 	"crypto"
 	"crypto/rsa"
 	"crypto/x509"
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"net"
 	"strings"
+	"sync"
 
 	"golang.org/x/crypto/ed25519"
 )
@@ -45,6 +45,19 @@ func (v ed25519Verifier) Verify(hash crypto.Hash, hashed, sig []byte) error {
 	return nil
 }
 
+// signatureSize returns the size in bytes of signatures made with the key of
+// v, or zero if unknown.
+func signatureSize(v verifier) int {
+	switch pub := v.Public().(type) {
+	case *rsa.PublicKey:
+		return pub.Size()
+	case ed25519.PublicKey:
+		return ed25519.SignatureSize
+	default:
+		return 0
+	}
+}
+
 type queryResult struct {
 	Verifier  verifier
 	KeyAlgo   string
@@ -65,8 +78,85 @@ const (
 type txtLookupFunc func(domain string) ([]string, error)
 type queryFunc func(domain, selector string, txtLookup txtLookupFunc) (*queryResult, error)
 
-var queryMethods = map[QueryMethod]queryFunc{
-	QueryMethodDNSTXT: queryDNSTXT,
+var (
+	queryMethodsMu sync.RWMutex
+	queryMethods   = map[QueryMethod]queryFunc{
+		QueryMethodDNSTXT: queryDNSTXT,
+	}
+)
+
+// QueryFunc looks up the public key of a selector in a domain, for a custom
+// query method registered in VerifyOptions.QueryMethods.
+//
+// Errors are classified like those returned by VerifyOptions.LookupTXT. A
+// *net.DNSError with IsTemporary set results in a temporary failure, other
+// errors result in a permanent failure.
+type QueryFunc func(domain, selector string) (*PublicKey, error)
+
+func (f QueryFunc) query(domain, selector string, txtLookup txtLookupFunc) (*queryResult, error) {
+	pub, err := f(domain, selector)
+	if err != nil {
+		if IsPermFail(err) || IsTempFail(err) {
+			return nil, err
+		}
+		return nil, classifyLookupError(err)
+	}
+
+	res := &queryResult{
+		HashAlgos: pub.HashAlgos,
+		Notes:     pub.Notes,
+		Services:  pub.Services,
+		Flags:     pub.Flags,
+	}
+	switch key := pub.Key.(type) {
+	case *rsa.PublicKey:
+		// RFC 8301 section 3.2
+		if key.Size()*8 < 1024 {
+			return nil, permFailError(fmt.Sprintf("key is too short: want 1024 bits, has %v bits", key.Size()*8))
+		}
+		res.Verifier = rsaVerifier{key}
+		res.KeyAlgo = "rsa"
+	case ed25519.PublicKey:
+		res.Verifier = ed25519Verifier{key}
+		res.KeyAlgo = "ed25519"
+	default:
+		return nil, permFailError("unsupported key algorithm")
+	}
+	return res, nil
+}
+
+// RegisterQueryMethod registers a public key query method for all
+// verifications, e.g. an HTTP-based key service or a local cache. Built-in
+// methods such as QueryMethodDNSTXT can be overridden. Methods registered in
+// VerifyOptions.QueryMethods take precedence.
+//
+// RegisterQueryMethod is typically called during initialization.
+func RegisterQueryMethod(method QueryMethod, fn QueryFunc) {
+	queryMethodsMu.Lock()
+	defer queryMethodsMu.Unlock()
+	queryMethods[method] = fn.query
+}
+
+// lookupQueryMethod finds the query function for a q= tag entry. Entries have
+// the form "type[/options]": unknown trailing options are ignored. Methods
+// registered in custom take precedence over built-in ones.
+func lookupQueryMethod(method string, custom map[QueryMethod]QueryFunc) (queryFunc, bool) {
+	for {
+		if query, ok := custom[QueryMethod(method)]; ok {
+			return query.query, true
+		}
+		queryMethodsMu.RLock()
+		query, ok := queryMethods[QueryMethod(method)]
+		queryMethodsMu.RUnlock()
+		if ok {
+			return query, true
+		}
+		i := strings.LastIndexByte(method, '/')
+		if i < 0 {
+			return nil, false
+		}
+		method = method[:i]
+	}
 }
 
 func queryDNSTXT(domain, selector string, txtLookup txtLookupFunc) (*queryResult, error) {
@@ -75,10 +165,8 @@ func queryDNSTXT(domain, selector string, txtLookup txtLookupFunc) (*queryResult
 	}
 
 	txts, err := txtLookup(selector + "._domainkey." + domain)
-	if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
-		return nil, tempFailError("key unavailable: " + err.Error())
-	} else if err != nil {
-		return nil, permFailError("no key for signature: " + err.Error())
+	if err != nil {
+		return nil, classifyLookupError(err)
 	}
 
 	// net.LookupTXT will concatenate strings contained in a single TXT record.
@@ -97,6 +185,96 @@ func queryDNSTXT(domain, selector string, txtLookup txtLookupFunc) (*queryResult
 	}
 }
 
+// withCNAME wraps a TXT lookup function to follow CNAME records. If the TXT
+// lookup of a name yields no records, the canonical name is resolved with
+// lookupCNAME and the TXT lookup is retried on it.
+//
+// Some resolvers fail to follow CNAME chains for TXT queries, which is common
+// for keys delegated to an email service provider.
+func withCNAME(lookupTXT txtLookupFunc, lookupCNAME func(name string) (string, error)) txtLookupFunc {
+	if lookupTXT == nil {
+		lookupTXT = net.LookupTXT
+	}
+	return func(name string) ([]string, error) {
+		txts, err := lookupTXT(name)
+		var dnsErr *net.DNSError
+		if len(txts) > 0 || (err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound)) {
+			return txts, err
+		}
+
+		cname, cnameErr := lookupCNAME(name)
+		if cnameErr != nil {
+			return txts, err
+		}
+		cname = strings.TrimSuffix(cname, ".")
+		if cname == "" || strings.EqualFold(cname, strings.TrimSuffix(name, ".")) {
+			return txts, err
+		}
+		return lookupTXT(cname)
+	}
+}
+
+// PublicKey is a parsed DKIM key record, as defined in RFC 6376 section 3.6.1.
+type PublicKey struct {
+	// The public key, either an *rsa.PublicKey or an ed25519.PublicKey.
+	Key crypto.PublicKey
+	// The key algorithm, either "rsa" or "ed25519".
+	KeyAlgo string
+	// The acceptable hash algorithms. If nil, all algorithms are allowed.
+	HashAlgos []string
+	// Notes that might be of interest to a human.
+	Notes string
+	// The service types the key applies to. If nil, all services are allowed.
+	Services []string
+	// The flags, e.g. "y" (testing mode) or "s" (strict identity).
+	Flags []string
+}
+
+// QueryPublicKey looks up the public key record for a selector in a domain,
+// using the DNS TXT query method. If lookupTXT is nil, net.LookupTXT is used.
+func QueryPublicKey(domain, selector string, lookupTXT func(domain string) ([]string, error)) (*PublicKey, error) {
+	res, err := queryDNSTXT(domain, selector, lookupTXT)
+	if err != nil {
+		return nil, err
+	}
+	return res.publicKey(), nil
+}
+
+// ParsePublicKey parses a DKIM key record, as published in DNS TXT records.
+// RSA keys shorter than 1024 bits are rejected, as required by RFC 8301.
+func ParsePublicKey(s string) (*PublicKey, error) {
+	res, err := parsePublicKey(s)
+	if err != nil {
+		return nil, err
+	}
+	return res.publicKey(), nil
+}
+
+func (res *queryResult) publicKey() *PublicKey {
+	return &PublicKey{
+		Key:       res.Verifier.Public(),
+		KeyAlgo:   res.KeyAlgo,
+		HashAlgos: res.HashAlgos,
+		Notes:     res.Notes,
+		Services:  res.Services,
+		Flags:     res.Flags,
+	}
+}
+
+// classifyLookupError converts a key lookup error into a DKIM failure: a
+// temporary DNS error is a temperror, anything else a permerror.
+func classifyLookupError(err error) error {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return permFailError("no key for signature: " + err.Error())
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Temporary() {
+		return tempFailError("key unavailable: " + err.Error())
+	}
+	return permFailError("no key for signature: " + err.Error())
+}
+
 func parsePublicKey(s string) (*queryResult, error) {
 	params, err := parseHeaderParams(s)
 	if err != nil {
@@ -105,6 +283,8 @@ func parsePublicKey(s string) (*queryResult, error) {
 
 	res := new(queryResult)
 
+	// RFC 6376 section 3.6.1: the v= tag is recommended, not required. Many
+	// providers omit it, in which case the record is treated as "DKIM1".
 	if v, ok := params["v"]; ok && v != "DKIM1" {
 		return nil, permFailError("incompatible public key version")
 	}
@@ -114,10 +294,9 @@ func parsePublicKey(s string) (*queryResult, error) {
 		return nil, permFailError("key syntax error: missing public key data")
 	}
 	if p == "" {
-		return nil, permFailError("key revoked")
+		return nil, ErrKeyRevoked
 	}
-	p = strings.ReplaceAll(p, " ", "")
-	b, err := base64.StdEncoding.DecodeString(p)
+	b, err := decodeBase64String(p)
 	if err != nil {
 		return nil, permFailError("key syntax error: " + err.Error())
 	}
@@ -156,7 +335,8 @@ func parsePublicKey(s string) (*queryResult, error) {
 		return nil, permFailError("unsupported key algorithm")
 	}
 
-	if hashesStr, ok := params["h"]; ok {
+	// An empty list of hash algorithms doesn't restrict them
+	if hashesStr, ok := params["h"]; ok && stripWhitespace(hashesStr) != "" {
 		res.HashAlgos = parseTagList(hashesStr)
 	}
 	if notes, ok := params["n"]; ok {
@@ -1,7 +1,18 @@
 package dkim
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"math/big"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
 )
 
 const dnsRawRSAPublicKey = "v=DKIM1; p=MIGJAoGBALVI635dLK4cJJAH3Lx6upo3X/L" +
@@ -16,21 +27,509 @@ const dnsPublicKey = "v=DKIM1; p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQ" +
 	"/RtdC2UzJ1lWT947qR+Rcac2gbto/NMqJ0fzfVjH4OuKhi" +
 	"tdY9tf6mcwGjaNBcWToIMmPSPDdQPNUYckcQ2QIDAQAB"
 
+// dnsRFC8463PublicKey is the RSA public key of the RFC 8463 appendix A
+// example.
+const dnsRFC8463PublicKey = "v=DKIM1; k=rsa; p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQ" +
+	"KBgQDkHlOQoBTzWRiGs5V6NpP3idY6Wk08a5qhdR6wy5bdOKb2jLQiY/J16JYi0Qvx/byYzC" +
+	"Nb3W91y3FutACDfzwQ/BC/e/8uBsCR+yz1Lxj+PL6lHvqMKrM3rG4hstT5QjvHO9PzoxZyVY" +
+	"LzBfO2EeC3Ip3G+2kryOTIKT+l/K4w3QIDAQAB"
+
 const dnsEd25519PublicKey = "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
 
 func init() {
-	queryMethods["dns/txt"] = queryTest
+	setQueryMethod(QueryMethodDNSTXT, queryTest)
+}
+
+// setQueryMethod replaces a built-in query method while holding the lock,
+// and returns the previous one.
+func setQueryMethod(method QueryMethod, query queryFunc) queryFunc {
+	queryMethodsMu.Lock()
+	defer queryMethodsMu.Unlock()
+	prev := queryMethods[method]
+	queryMethods[method] = query
+	return prev
+}
+
+// mustParsePublicKey parses a test key record, for use in expected
+// verification results.
+func mustParsePublicKey(s string) *PublicKey {
+	res, err := parsePublicKey(s)
+	if err != nil {
+		panic(err)
+	}
+	return res.publicKey()
 }
 
 func queryTest(domain, selector string, txtLookup txtLookupFunc) (*queryResult, error) {
 	record := selector + "._domainkey." + domain
 	switch record {
-	case "brisbane._domainkey.example.com", "brisbane._domainkey.example.org", "test._domainkey.football.example.com":
+	case "brisbane._domainkey.example.com", "brisbane._domainkey.example.org":
 		return parsePublicKey(dnsPublicKey)
+	case "test._domainkey.football.example.com":
+		return parsePublicKey(dnsRFC8463PublicKey)
 	case "newengland._domainkey.example.com":
 		return parsePublicKey(dnsRawRSAPublicKey)
 	case "brisbane._domainkey.football.example.com":
 		return parsePublicKey(dnsEd25519PublicKey)
+	case "tlsrpt._domainkey.example.org":
+		return parsePublicKey(dnsPublicKey + "; s=tlsrpt")
+	case "emptyhash._domainkey.example.org":
+		return parsePublicKey(dnsPublicKey + "; h=")
+	case "sha256._domainkey.example.org":
+		return parsePublicKey(dnsPublicKey + "; h=sha256")
+	case "testing._domainkey.example.org":
+		return parsePublicKey(dnsPublicKey + "; t=y; s=email")
+	case "sha1._domainkey.example.org":
+		return parsePublicKey(dnsPublicKey + "; h=sha1")
+	case "revoked._domainkey.example.org":
+		return parsePublicKey("v=DKIM1; p=")
+	case "revoked-ed25519._domainkey.example.org":
+		return parsePublicKey("v=DKIM1; k=ed25519; p=")
 	}
 	return nil, fmt.Errorf("unknown test DNS record %v", record)
 }
+
+func TestQueryDNSTXT_lookupErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		tempFail bool
+	}{
+		{
+			name: "not found",
+			err:  &net.DNSError{Err: "no such host", Name: "brisbane._domainkey.example.com", IsNotFound: true},
+		},
+		{
+			name:     "temporary",
+			err:      &net.DNSError{Err: "server misbehaving", Name: "brisbane._domainkey.example.com", IsTemporary: true},
+			tempFail: true,
+		},
+		{
+			name:     "wrapped temporary",
+			err:      fmt.Errorf("lookup failed: %w", &net.DNSError{Err: "i/o timeout", IsTimeout: true}),
+			tempFail: true,
+		},
+		{
+			name: "other",
+			err:  errors.New("custom lookup failure"),
+		},
+	}
+
+	for _, test := range tests {
+		lookup := func(domain string) ([]string, error) {
+			return nil, test.err
+		}
+		_, err := queryDNSTXT("example.com", "brisbane", lookup)
+		if test.tempFail && !IsTempFail(err) {
+			t.Errorf("%v: expected a temporary failure, got: %v", test.name, err)
+		} else if !test.tempFail && !IsPermFail(err) {
+			t.Errorf("%v: expected a permanent failure, got: %v", test.name, err)
+		}
+	}
+}
+
+func TestVerify_cname(t *testing.T) {
+	const target = "s1.domainkey.u1.wl.sendgrid.net"
+	lookupTXT := func(domain string) ([]string, error) {
+		if domain != target {
+			return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+		}
+		return []string{dnsPublicKey}, nil
+	}
+	lookupCNAME := func(domain string) (string, error) {
+		if domain == "s1._domainkey.example.com" {
+			return target + ".", nil
+		}
+		return domain + ".", nil
+	}
+
+	if _, err := queryDNSTXT("example.com", "s1", withCNAME(lookupTXT, lookupCNAME)); err != nil {
+		t.Errorf("Expected no error when following CNAME, got: %v", err)
+	}
+	if _, err := queryDNSTXT("example.com", "s1", lookupTXT); !IsPermFail(err) {
+		t.Errorf("Expected a permanent failure without following CNAME, got: %v", err)
+	}
+	if _, err := queryDNSTXT("example.com", "s2", withCNAME(lookupTXT, lookupCNAME)); !IsPermFail(err) {
+		t.Errorf("Expected a permanent failure for a name without CNAME, got: %v", err)
+	}
+
+	defer setQueryMethod(QueryMethodDNSTXT, setQueryMethod(QueryMethodDNSTXT, queryDNSTXT))
+
+	options := &SignOptions{
+		Domain:   "example.com",
+		Selector: "s1",
+		Signer:   testPrivateKey,
+	}
+	var b bytes.Buffer
+	if err := Sign(&b, strings.NewReader(mailString), options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	verifications, err := VerifyWithOptions(&b, &VerifyOptions{
+		LookupTXT:   lookupTXT,
+		LookupCNAME: lookupCNAME,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	} else if err := verifications[0].Err; err != nil {
+		t.Errorf("Expected no error when verifying signature, got: %v", err)
+	}
+}
+
+func TestRegisterQueryMethod(t *testing.T) {
+	const method QueryMethod = "x-registered"
+	var queried string
+	RegisterQueryMethod(method, func(domain, selector string) (*PublicKey, error) {
+		queried = selector + "._domainkey." + domain
+		return &PublicKey{Key: testEd25519PrivateKey.Public()}, nil
+	})
+	defer func() {
+		queryMethodsMu.Lock()
+		delete(queryMethods, method)
+		queryMethodsMu.Unlock()
+	}()
+
+	options := &SignOptions{
+		Domain:       "example.org",
+		Selector:     "registered",
+		Signer:       testEd25519PrivateKey,
+		QueryMethods: []QueryMethod{"x-unknown", method},
+	}
+	var b bytes.Buffer
+	if err := Sign(&b, strings.NewReader(mailString), options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	verifications, err := Verify(&b)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	} else if err := verifications[0].Err; err != nil {
+		t.Errorf("Expected no error when verifying signature, got: %v", err)
+	}
+	if want := "registered._domainkey.example.org"; queried != want {
+		t.Errorf("Expected registered query method to be called for %q, got %q", want, queried)
+	}
+}
+
+func TestLookupQueryMethod(t *testing.T) {
+	for _, method := range []string{"dns/txt", "dns/txt/foo"} {
+		if _, ok := lookupQueryMethod(method, nil); !ok {
+			t.Errorf("Expected query method %q to be supported", method)
+		}
+	}
+	for _, method := range []string{"dns", "dns/foo", "http/txt"} {
+		if _, ok := lookupQueryMethod(method, nil); ok {
+			t.Errorf("Expected query method %q to be unsupported", method)
+		}
+	}
+}
+
+func TestVerify_customQueryMethod(t *testing.T) {
+	r := strings.NewReader(mailString)
+	options := &SignOptions{
+		Domain:       "example.org",
+		Selector:     "memory",
+		Signer:       testEd25519PrivateKey,
+		QueryMethods: []QueryMethod{"x-memory", QueryMethodDNSTXT},
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	var queried string
+	verifOptions := &VerifyOptions{
+		QueryMethods: map[QueryMethod]QueryFunc{
+			"x-memory": func(domain, selector string) (*PublicKey, error) {
+				queried = selector + "._domainkey." + domain
+				return &PublicKey{Key: testEd25519PrivateKey.Public()}, nil
+			},
+		},
+	}
+	verifications, err := VerifyWithOptions(&b, verifOptions)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	} else if err := verifications[0].Err; err != nil {
+		t.Errorf("Expected no error when verifying signature, got: %v", err)
+	}
+	if want := "memory._domainkey.example.org"; queried != want {
+		t.Errorf("Expected custom query method to be called for %q, got %q", want, queried)
+	}
+}
+
+func TestParsePublicKey_unpadded(t *testing.T) {
+	s := strings.TrimRight(dnsEd25519PublicKey, "=")
+	res, err := parsePublicKey(s)
+	if err != nil {
+		t.Fatalf("Expected no error while parsing unpadded public key, got: %v", err)
+	}
+	if res.KeyAlgo != "ed25519" {
+		t.Errorf("Expected key algorithm to be ed25519, got %v", res.KeyAlgo)
+	}
+}
+
+func TestParsePublicKey_noVersion(t *testing.T) {
+	p := strings.TrimPrefix(dnsPublicKey, "v=DKIM1; ")
+	tests := []struct {
+		name   string
+		record string
+		flags  []string
+	}{
+		// Records in the style published by Sendgrid and GitLab, which lack
+		// the v= tag
+		{"sendgrid", "k=rsa; t=s; " + p, []string{"s"}},
+		{"gitlab", "k=rsa; " + p, nil},
+		{"bare", p, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := parsePublicKey(test.record)
+			if err != nil {
+				t.Fatalf("Expected no error while parsing public key without v=, got: %v", err)
+			}
+			if res.KeyAlgo != "rsa" {
+				t.Errorf("Expected key algorithm to be rsa, got %v", res.KeyAlgo)
+			}
+			if !reflect.DeepEqual(res.Flags, test.flags) {
+				t.Errorf("Expected flags to be %v, got %v", test.flags, res.Flags)
+			}
+		})
+	}
+
+	if _, err := parsePublicKey("v=DKIM2; " + p); !IsPermFail(err) {
+		t.Errorf("Expected a permanent failure for an incompatible version, got: %v", err)
+	}
+}
+
+func TestParsePublicKey_rsaEncodings(t *testing.T) {
+	short := &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 511), E: 65537}
+	short.N.Add(short.N, big.NewInt(1))
+	shortPKIX, err := x509.MarshalPKIXPublicKey(short)
+	if err != nil {
+		t.Fatalf("Expected no error while marshaling key, got: %v", err)
+	}
+	shortPKCS1 := x509.MarshalPKCS1PublicKey(short)
+
+	tests := []struct {
+		name   string
+		record string
+		ok     bool
+	}{
+		{"pkix", dnsPublicKey, true},
+		{"pkcs1", dnsRawRSAPublicKey, true},
+		{"short pkix", "v=DKIM1; p=" + base64.StdEncoding.EncodeToString(shortPKIX), false},
+		{"short pkcs1", "v=DKIM1; p=" + base64.StdEncoding.EncodeToString(shortPKCS1), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := parsePublicKey(test.record)
+			if test.ok {
+				if err != nil {
+					t.Fatalf("Expected no error while parsing public key, got: %v", err)
+				}
+				if res.KeyAlgo != "rsa" {
+					t.Errorf("Expected key algorithm to be rsa, got %v", res.KeyAlgo)
+				}
+			} else if !IsPermFail(err) || !strings.Contains(err.Error(), "too short") {
+				t.Errorf("Expected a key too short error, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestParsePublicKey_services(t *testing.T) {
+	tests := []struct {
+		services string
+		want     []string
+	}{
+		{"*", nil},
+		{"email", []string{"email"}},
+		{"email:tlsrpt", []string{"email", "tlsrpt"}},
+		{"tlsrpt", []string{"tlsrpt"}},
+	}
+
+	for _, test := range tests {
+		res, err := parsePublicKey(dnsPublicKey + "; s=" + test.services)
+		if err != nil {
+			t.Fatalf("Expected no error while parsing public key with s=%v, got: %v", test.services, err)
+		}
+		if !reflect.DeepEqual(res.Services, test.want) {
+			t.Errorf("Expected services for s=%v to be %v, got %v", test.services, test.want, res.Services)
+		}
+	}
+}
+
+func TestVerify_inappropriateService(t *testing.T) {
+	r := strings.NewReader(mailString)
+	options := &SignOptions{
+		Domain:   "example.org",
+		Selector: "tlsrpt",
+		Signer:   testPrivateKey,
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	verifications, err := Verify(&b)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+
+	err = verifications[0].Err
+	if !IsPermFail(err) {
+		t.Fatalf("Expected a permanent failure, got: %v", err)
+	} else if !strings.Contains(err.Error(), "inappropriate service") {
+		t.Errorf("Expected an inappropriate service error, got: %v", err)
+	}
+}
+
+func TestVerify_keyRevoked(t *testing.T) {
+	tests := []struct {
+		selector string
+		signer   crypto.Signer
+	}{
+		{"revoked", testPrivateKey},
+		{"revoked-ed25519", testEd25519PrivateKey},
+	}
+
+	for _, test := range tests {
+		t.Run(test.selector, func(t *testing.T) {
+			r := strings.NewReader(mailString)
+			options := &SignOptions{
+				Domain:   "example.org",
+				Selector: test.selector,
+				Signer:   test.signer,
+			}
+
+			var b bytes.Buffer
+			if err := Sign(&b, r, options); err != nil {
+				t.Fatal("Expected no error while signing mail, got:", err)
+			}
+
+			verifications, err := Verify(&b)
+			if err != nil {
+				t.Fatalf("Expected no error while verifying signature, got: %v", err)
+			} else if len(verifications) != 1 {
+				t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+			}
+
+			err = verifications[0].Err
+			if err != ErrKeyRevoked {
+				t.Errorf("Expected ErrKeyRevoked, got: %v", err)
+			} else if !IsPermFail(err) {
+				t.Errorf("Expected a permanent failure, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestParsePublicKey_hashAlgos(t *testing.T) {
+	tests := []struct {
+		hashes string
+		want   []string
+	}{
+		{"", nil},
+		{" ", nil},
+		{"sha256", []string{"sha256"}},
+		{"sha1 : sha256", []string{"sha1", "sha256"}},
+	}
+
+	for _, test := range tests {
+		res, err := parsePublicKey(dnsPublicKey + "; h=" + test.hashes)
+		if err != nil {
+			t.Fatalf("Expected no error while parsing public key with h=%v, got: %v", test.hashes, err)
+		}
+		if !reflect.DeepEqual(res.HashAlgos, test.want) {
+			t.Errorf("Expected hash algorithms for h=%v to be %v, got %v", test.hashes, test.want, res.HashAlgos)
+		}
+	}
+}
+
+func TestVerify_hashAlgos(t *testing.T) {
+	tests := []struct {
+		selector string
+		ok       bool
+	}{
+		{"emptyhash", true},
+		{"sha256", true},
+		{"sha1", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.selector, func(t *testing.T) {
+			r := strings.NewReader(mailString)
+			options := &SignOptions{
+				Domain:   "example.org",
+				Selector: test.selector,
+				Signer:   testPrivateKey,
+			}
+
+			var b bytes.Buffer
+			if err := Sign(&b, r, options); err != nil {
+				t.Fatal("Expected no error while signing mail, got:", err)
+			}
+
+			verifications, err := Verify(&b)
+			if err != nil {
+				t.Fatalf("Expected no error while verifying signature, got: %v", err)
+			} else if len(verifications) != 1 {
+				t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+			}
+
+			err = verifications[0].Err
+			if test.ok && err != nil {
+				t.Errorf("Expected no error, got: %v", err)
+			} else if !test.ok && !IsPermFail(err) {
+				t.Errorf("Expected an inappropriate hash algorithm error, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestQueryPublicKey(t *testing.T) {
+	lookupTXT := func(domain string) ([]string, error) {
+		if domain != "brisbane._domainkey.example.com" {
+			return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+		}
+		return []string{dnsPublicKey + "; h=sha256; t=y:s; s=email"}, nil
+	}
+
+	pub, err := QueryPublicKey("example.com", "brisbane", lookupTXT)
+	if err != nil {
+		t.Fatalf("Expected no error while querying public key, got: %v", err)
+	}
+	if pub.KeyAlgo != "rsa" {
+		t.Errorf("Expected key algorithm to be rsa, got %v", pub.KeyAlgo)
+	}
+	if rsaPub, ok := pub.Key.(*rsa.PublicKey); !ok {
+		t.Errorf("Expected an RSA public key, got %T", pub.Key)
+	} else if rsaPub.N.BitLen() != 1024 {
+		t.Errorf("Expected a 1024-bit key, got %v bits", rsaPub.N.BitLen())
+	}
+	if !reflect.DeepEqual(pub.HashAlgos, []string{"sha256"}) {
+		t.Errorf("Expected hash algorithms to be [sha256], got %v", pub.HashAlgos)
+	}
+	if !reflect.DeepEqual(pub.Flags, []string{"y", "s"}) {
+		t.Errorf("Expected flags to be [y s], got %v", pub.Flags)
+	}
+	if !reflect.DeepEqual(pub.Services, []string{"email"}) {
+		t.Errorf("Expected services to be [email], got %v", pub.Services)
+	}
+
+	if _, err := QueryPublicKey("example.com", "missing", lookupTXT); !IsPermFail(err) {
+		t.Errorf("Expected a permanent failure for a missing key, got: %v", err)
+	}
+}
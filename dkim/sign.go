@@ -6,7 +6,9 @@ import (
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"strconv"
@@ -33,7 +35,8 @@ type SignOptions struct {
 	// This can't be empty.
 	Selector string
 	// The Agent or User Identifier (AUID) on behalf of which the SDID is taking
-	// responsibility.
+	// responsibility. Special characters are encoded with the DKIM
+	// quoted-printable encoding.
 	//
 	// This is optional.
 	Identifier string
@@ -48,6 +51,10 @@ type SignOptions struct {
 	//
 	// The only supported hash algorithm is crypto.SHA256.
 	Hash crypto.Hash
+	// The name of the hash algorithm used to sign the message, e.g. "sha256".
+	// It's an alternative to Hash, for instance for configuration files. If
+	// both are set, they must designate the same algorithm.
+	HashAlgorithm string
 
 	// Header and body canonicalization algorithms.
 	//
@@ -64,10 +71,101 @@ type SignOptions struct {
 	// The expiration time. A zero value means no expiration.
 	Expiration time.Time
 
+	// The number of canonicalized body bytes to sign. If zero, the whole body
+	// is signed. It must not exceed the length of the canonicalized body.
+	//
+	// Signing only part of the body allows content to be appended to the
+	// message without breaking the signature, which is insecure. See RFC 6376
+	// section 8.2.
+	BodyLength int64
+
 	// A list of query methods used to retrieve the public key.
 	//
 	// If nil, it is implicitly defined as QueryMethodDNSTXT.
 	QueryMethods []QueryMethod
+
+	// Now returns the current time, used as the signature timestamp. If nil,
+	// time.Now is used.
+	Now func() time.Time
+	// The signature timestamp. If non-zero, it's used instead of the current
+	// time. See FreezeTimestamp.
+	SignatureTimestamp time.Time
+
+	// AllowMissingBody allows signing messages whose header isn't followed by
+	// the blank line separating it from the body. Such messages are signed as
+	// if they had an empty body.
+	AllowMissingBody bool
+
+	// InsertAfter is the name of the header field after which Sign inserts
+	// the DKIM-Signature header field. The signature is inserted after the
+	// last field with this name. If empty or if the message has no such
+	// field, the signature is prepended to the message.
+	InsertAfter string
+
+	// ExistingSignatures, if non-nil, is called with the SDIDs of the
+	// DKIM-Signature header fields already present in the message, if any.
+	// The SDID of a malformed signature is empty. It can be used to detect
+	// messages which are accidentally signed twice.
+	//
+	// When using a Signer, it's called before Signer.Close returns.
+	ExistingSignatures func(domains []string)
+}
+
+// FreezeTimestamp returns a copy of options with SignatureTimestamp set to the
+// current time, truncated to the second. It can be used to sign a batch of
+// messages with a single timestamp. If SignatureTimestamp is already set, it's
+// left as-is.
+func FreezeTimestamp(options *SignOptions) *SignOptions {
+	frozen := *options
+	if frozen.SignatureTimestamp.IsZero() {
+		t := now()
+		if frozen.Now != nil {
+			t = frozen.Now()
+		}
+		frozen.SignatureTimestamp = t.UTC().Truncate(time.Second)
+	}
+	return &frozen
+}
+
+// ParsePrivateKey parses a PEM-encoded private key, for use in
+// SignOptions.Signer.
+//
+// PKCS#8 ("PRIVATE KEY") RSA and Ed25519 keys, as generated by dkim-keygen or
+// "openssl genpkey", and PKCS#1 ("RSA PRIVATE KEY") RSA keys are supported.
+func ParsePrivateKey(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("dkim: no PEM data found")
+	}
+
+	switch strings.ToUpper(block.Type) {
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("dkim: failed to parse PKCS#8 private key: %v", err)
+		}
+		signer, ok := k.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("dkim: unsupported private key type %T", k)
+		}
+		return signer, nil
+	case "RSA PRIVATE KEY":
+		k, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("dkim: failed to parse PKCS#1 private key: %v", err)
+		}
+		return k, nil
+	case "EDDSA PRIVATE KEY":
+		// Non-standard format, kept for backwards compatibility
+		if len(block.Bytes) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("dkim: invalid Ed25519 private key size")
+		}
+		return ed25519.PrivateKey(block.Bytes), nil
+	case "OPENSSH PRIVATE KEY":
+		return nil, fmt.Errorf("dkim: OpenSSH private keys are not supported, convert the key to PKCS#8 with \"ssh-keygen -p -m PKCS8 -f <file>\"")
+	default:
+		return nil, fmt.Errorf("dkim: unknown private key type %q", block.Type)
+	}
 }
 
 // Signer generates a DKIM signature.
@@ -88,6 +186,66 @@ type Signer struct {
 // NewSigner creates a new signer. It returns an error if SignOptions is
 // invalid.
 func NewSigner(options *SignOptions) (*Signer, error) {
+	cfg, err := newSignConfig(options)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	pr, pw := io.Pipe()
+
+	s := &Signer{
+		pw:   pw,
+		done: done,
+	}
+
+	closeReadWithError := func(err error) {
+		pr.CloseWithError(err)
+		done <- err
+	}
+
+	go func() {
+		defer close(done)
+
+		// Read header
+		br := bufio.NewReader(pr)
+		h, err := readHeaderAllowEOF(br, options.AllowMissingBody)
+		if err != nil {
+			closeReadWithError(err)
+			return
+		}
+		cfg.reportExistingSignatures(h)
+
+		bodyHashed, err := cfg.hashBody(br)
+		if err != nil {
+			closeReadWithError(err)
+			return
+		}
+
+		params, err := cfg.sign(h, bodyHashed)
+		if err != nil {
+			closeReadWithError(err)
+			return
+		}
+
+		s.sigParams = params
+		closeReadWithError(nil)
+	}()
+
+	return s, nil
+}
+
+// signConfig holds validated signing options.
+type signConfig struct {
+	options   *SignOptions
+	headerCan Canonicalization
+	bodyCan   Canonicalization
+	keyAlgo   string
+	hash      crypto.Hash
+	hashAlgo  string
+}
+
+func newSignConfig(options *SignOptions) (*signConfig, error) {
 	if options == nil {
 		return nil, fmt.Errorf("dkim: no options specified")
 	}
@@ -128,8 +286,21 @@ func NewSigner(options *SignOptions) (*Signer, error) {
 	}
 
 	hash := options.Hash
+	if options.HashAlgorithm != "" {
+		var h crypto.Hash
+		switch strings.ToLower(options.HashAlgorithm) {
+		case "sha256":
+			h = crypto.SHA256
+		default:
+			return nil, fmt.Errorf("dkim: unknown hash algorithm %q", options.HashAlgorithm)
+		}
+		if hash != 0 && hash != h {
+			return nil, fmt.Errorf("dkim: hash algorithm %q doesn't match Hash", options.HashAlgorithm)
+		}
+		hash = h
+	}
 	var hashAlgo string
-	switch options.Hash {
+	switch hash {
 	case 0: // sha256 is the default
 		hash = crypto.SHA256
 		fallthrough
@@ -141,6 +312,10 @@ func NewSigner(options *SignOptions) (*Signer, error) {
 		return nil, fmt.Errorf("dkim: unsupported hash algorithm")
 	}
 
+	if options.BodyLength < 0 {
+		return nil, fmt.Errorf("dkim: invalid body length")
+	}
+
 	if options.HeaderKeys != nil {
 		ok := false
 		for _, k := range options.HeaderKeys {
@@ -154,133 +329,164 @@ func NewSigner(options *SignOptions) (*Signer, error) {
 		}
 	}
 
-	done := make(chan error, 1)
-	pr, pw := io.Pipe()
+	return &signConfig{
+		options:   options,
+		headerCan: headerCan,
+		bodyCan:   bodyCan,
+		keyAlgo:   keyAlgo,
+		hash:      hash,
+		hashAlgo:  hashAlgo,
+	}, nil
+}
 
-	s := &Signer{
-		pw:   pw,
-		done: done,
+// reportExistingSignatures calls the ExistingSignatures callback if the
+// header h contains DKIM signatures.
+func (cfg *signConfig) reportExistingSignatures(h header) {
+	if cfg.options.ExistingSignatures == nil {
+		return
 	}
 
-	closeReadWithError := func(err error) {
-		pr.CloseWithError(err)
-		done <- err
+	var domains []string
+	for _, kv := range h {
+		k, v := parseHeaderField(kv)
+		if !strings.EqualFold(k, headerFieldName) {
+			continue
+		}
+		var d string
+		if params, err := parseHeaderParams(v); err == nil {
+			d = stripWhitespace(params["d"])
+		}
+		domains = append(domains, d)
+	}
+	if len(domains) > 0 {
+		cfg.options.ExistingSignatures(domains)
 	}
+}
 
-	go func() {
-		defer close(done)
+// hashBody computes the hash of the canonicalized message body read from r.
+func (cfg *signConfig) hashBody(r io.Reader) ([]byte, error) {
+	hasher := cfg.hash.New()
+	var bodyWriter io.Writer = hasher
+	var lw *limitedWriter
+	if cfg.options.BodyLength > 0 {
+		lw = &limitedWriter{W: hasher, N: cfg.options.BodyLength}
+		bodyWriter = lw
+	}
+	can := canonicalizers[cfg.bodyCan].CanonicalizeBody(bodyWriter)
+	if _, err := io.Copy(can, r); err != nil {
+		return nil, err
+	}
+	if err := can.Close(); err != nil {
+		return nil, err
+	}
+	// The signature can't claim to sign bytes which don't exist
+	if lw != nil && lw.N > 0 {
+		return nil, fmt.Errorf("dkim: body length (%v bytes) exceeds the canonicalized body length (%v bytes)", cfg.options.BodyLength, cfg.options.BodyLength-lw.N)
+	}
+	return hasher.Sum(nil), nil
+}
 
-		// Read header
-		br := bufio.NewReader(pr)
-		h, err := readHeader(br)
-		if err != nil {
-			closeReadWithError(err)
-			return
-		}
+// sign signs the message header and body hash, and returns the signature
+// params.
+func (cfg *signConfig) sign(h header, bodyHashed []byte) (map[string]string, error) {
+	options := cfg.options
 
-		// Hash body
-		hasher := hash.New()
-		can := canonicalizers[bodyCan].CanonicalizeBody(hasher)
-		if _, err := io.Copy(can, br); err != nil {
-			closeReadWithError(err)
-			return
-		}
-		if err := can.Close(); err != nil {
-			closeReadWithError(err)
-			return
-		}
-		bodyHashed := hasher.Sum(nil)
-
-		params := map[string]string{
-			"v":  "1",
-			"a":  keyAlgo + "-" + hashAlgo,
-			"bh": base64.StdEncoding.EncodeToString(bodyHashed),
-			"c":  string(headerCan) + "/" + string(bodyCan),
-			"d":  options.Domain,
-			//"l": "", // TODO
-			"s": options.Selector,
-			"t": formatTime(now()),
-			//"z": "", // TODO
-		}
+	signTime := options.SignatureTimestamp
+	if signTime.IsZero() && options.Now != nil {
+		signTime = options.Now()
+	} else if signTime.IsZero() {
+		signTime = now()
+	}
 
-		var headerKeys []string
-		if options.HeaderKeys != nil {
-			headerKeys = options.HeaderKeys
-		} else {
-			for _, kv := range h {
-				k, _ := parseHeaderField(kv)
-				headerKeys = append(headerKeys, k)
-			}
-		}
-		params["h"] = formatTagList(headerKeys)
+	params := map[string]string{
+		"v":  "1",
+		"a":  cfg.keyAlgo + "-" + cfg.hashAlgo,
+		"bh": base64.StdEncoding.EncodeToString(bodyHashed),
+		"c":  string(cfg.headerCan) + "/" + string(cfg.bodyCan),
+		"d":  options.Domain,
+		"s":  options.Selector,
+		"t":  formatTime(signTime),
+		//"z": "", // TODO
+	}
 
-		if options.Identifier != "" {
-			params["i"] = options.Identifier
+	var headerKeys []string
+	if options.HeaderKeys != nil {
+		headerKeys = options.HeaderKeys
+	} else {
+		for _, kv := range h {
+			k, _ := parseHeaderField(kv)
+			headerKeys = append(headerKeys, k)
 		}
+	}
+	params["h"] = formatTagList(headerKeys)
 
-		if options.QueryMethods != nil {
-			methods := make([]string, len(options.QueryMethods))
-			for i, method := range options.QueryMethods {
-				methods[i] = string(method)
-			}
-			params["q"] = formatTagList(methods)
-		}
+	if options.Identifier != "" {
+		params["i"] = encodeQuotedPrintable(options.Identifier)
+	}
 
-		if !options.Expiration.IsZero() {
-			params["x"] = formatTime(options.Expiration)
+	if options.QueryMethods != nil {
+		methods := make([]string, len(options.QueryMethods))
+		for i, method := range options.QueryMethods {
+			methods[i] = string(method)
 		}
+		params["q"] = formatTagList(methods)
+	}
 
-		// Hash and sign headers
-		hasher.Reset()
-		picker := newHeaderPicker(h)
-		for _, k := range headerKeys {
-			kv := picker.Pick(k)
-			if kv == "" {
-				// The Signer MAY include more instances of a header field name
-				// in "h=" than there are actual corresponding header fields so
-				// that the signature will not verify if additional header
-				// fields of that name are added.
-				continue
-			}
+	if options.BodyLength > 0 {
+		params["l"] = strconv.FormatInt(options.BodyLength, 10)
+	}
 
-			kv = canonicalizers[headerCan].CanonicalizeHeader(kv)
-			if _, err := io.WriteString(hasher, kv); err != nil {
-				closeReadWithError(err)
-				return
-			}
-		}
+	if !options.Expiration.IsZero() {
+		params["x"] = formatTime(options.Expiration)
+	}
 
-		params["b"] = ""
-		sigField := formatSignature(params)
-		sigField = canonicalizers[headerCan].CanonicalizeHeader(sigField)
-		sigField = strings.TrimRight(sigField, crlf)
-		if _, err := io.WriteString(hasher, sigField); err != nil {
-			closeReadWithError(err)
-			return
+	// Hash and sign headers
+	hasher := cfg.hash.New()
+	picker := newHeaderPicker(h)
+	for _, k := range headerKeys {
+		kv := picker.Pick(k)
+		if kv == "" {
+			// The Signer MAY include more instances of a header field name
+			// in "h=" than there are actual corresponding header fields so
+			// that the signature will not verify if additional header
+			// fields of that name are added.
+			continue
 		}
-		hashed := hasher.Sum(nil)
 
-		// Don't pass Hash to Sign for ed25519 as it doesn't support it
-		// and will return an error ("ed25519: cannot sign hashed message").
-		if keyAlgo == "ed25519" {
-			hash = crypto.Hash(0)
+		kv = canonicalizers[cfg.headerCan].CanonicalizeHeader(kv)
+		if _, err := io.WriteString(hasher, kv); err != nil {
+			return nil, err
 		}
+	}
 
-		sig, err := options.Signer.Sign(randReader, hashed, hash)
-		if err != nil {
-			closeReadWithError(err)
-			return
-		}
-		params["b"] = base64.StdEncoding.EncodeToString(sig)
+	params["b"] = ""
+	sigField := formatSignature(params)
+	sigField = canonicalizers[cfg.headerCan].CanonicalizeHeader(sigField)
+	sigField = strings.TrimRight(sigField, crlf)
+	if _, err := io.WriteString(hasher, sigField); err != nil {
+		return nil, err
+	}
+	hashed := hasher.Sum(nil)
 
-		s.sigParams = params
-		closeReadWithError(nil)
-	}()
+	// Don't pass Hash to Sign for ed25519 as it doesn't support it
+	// and will return an error ("ed25519: cannot sign hashed message").
+	hash := cfg.hash
+	if cfg.keyAlgo == "ed25519" {
+		hash = crypto.Hash(0)
+	}
 
-	return s, nil
+	sig, err := options.Signer.Sign(randReader, hashed, hash)
+	if err != nil {
+		return nil, err
+	}
+	params["b"] = base64.StdEncoding.EncodeToString(sig)
+
+	return params, nil
 }
 
-// Write implements io.WriteCloser.
+// Write implements io.WriteCloser. The message must be written in order: the
+// header, the blank line terminating it, then the body. It may be split across
+// any number of Write calls.
 func (s *Signer) Write(b []byte) (n int, err error) {
 	return s.pw.Write(b)
 }
@@ -324,6 +530,14 @@ func Sign(w io.Writer, r io.Reader, options *SignOptions) error {
 	if err := s.Close(); err != nil {
 		return err
 	}
+	trimBOM(&b)
+	if options.AllowMissingBody {
+		terminateHeader(&b)
+	}
+
+	if options.InsertAfter != "" {
+		return insertSignature(w, &b, s.Signature(), options.InsertAfter)
+	}
 
 	if _, err := io.WriteString(w, s.Signature()); err != nil {
 		return err
@@ -332,6 +546,166 @@ func Sign(w io.Writer, r io.Reader, options *SignOptions) error {
 	return err
 }
 
+// bodyHashKey identifies the parameters a body hash depends on.
+type bodyHashKey struct {
+	can        Canonicalization
+	hash       crypto.Hash
+	bodyLength int64
+}
+
+// SignMultiple signs a message with multiple signatures, one per element of
+// options. It reads the message from r and writes the signed version to w.
+// The signatures are prepended to the message in the same order as options.
+//
+// The body is hashed only once for signatures sharing the same body
+// canonicalization, hash algorithm and body length.
+func SignMultiple(w io.Writer, r io.Reader, options []*SignOptions) error {
+	cfgs := make([]*signConfig, len(options))
+	for i, opts := range options {
+		cfg, err := newSignConfig(opts)
+		if err != nil {
+			return err
+		}
+		cfgs[i] = cfg
+	}
+
+	// We need to keep the message in a buffer so we can write the new DKIM
+	// header fields before the rest of the message
+	var b bytes.Buffer
+	if _, err := io.Copy(&b, r); err != nil {
+		return err
+	}
+	trimBOM(&b)
+
+	br := bufio.NewReader(bytes.NewReader(b.Bytes()))
+	h, err := readHeaderAllowEOF(br, allowMissingBody(options))
+	if err != nil {
+		return err
+	}
+	body, err := io.ReadAll(br)
+	if err != nil {
+		return err
+	}
+	if len(body) == 0 {
+		terminateHeader(&b)
+	}
+
+	bodyHashes := make(map[bodyHashKey][]byte)
+	sigs := make([]string, len(cfgs))
+	for i, cfg := range cfgs {
+		cfg.reportExistingSignatures(h)
+
+		k := bodyHashKey{cfg.bodyCan, cfg.hash, cfg.options.BodyLength}
+		bodyHashed, ok := bodyHashes[k]
+		if !ok {
+			bodyHashed, err = cfg.hashBody(bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			bodyHashes[k] = bodyHashed
+		}
+
+		params, err := cfg.sign(h, bodyHashed)
+		if err != nil {
+			return err
+		}
+		sigs[i] = formatSignature(params)
+	}
+
+	for _, sig := range sigs {
+		if _, err := io.WriteString(w, sig); err != nil {
+			return err
+		}
+	}
+	_, err = io.Copy(w, &b)
+	return err
+}
+
+func allowMissingBody(options []*SignOptions) bool {
+	for _, opts := range options {
+		if !opts.AllowMissingBody {
+			return false
+		}
+	}
+	return true
+}
+
+func insertSignature(w io.Writer, r io.Reader, sig, after string) error {
+	br := bufio.NewReader(r)
+	h, err := readHeaderAllowEOF(br, true)
+	if err != nil {
+		return err
+	}
+
+	at := 0
+	for i, kv := range h {
+		if k, _ := parseHeaderField(kv); strings.EqualFold(k, after) {
+			at = i + 1
+		}
+	}
+
+	signed := make(header, 0, len(h)+1)
+	signed = append(signed, h[:at]...)
+	signed = append(signed, sig)
+	signed = append(signed, h[at:]...)
+	if err := writeHeader(w, signed); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, br)
+	return err
+}
+
+// Resign signs a message like Sign. If removeExisting is true, existing
+// DKIM-Signature header fields are removed from the message before it's
+// signed. If domains are specified, only signatures whose SDID matches one of
+// them are removed.
+func Resign(w io.Writer, r io.Reader, options *SignOptions, removeExisting bool, domains ...string) error {
+	br := bufio.NewReader(r)
+	h, err := readHeader(br)
+	if err != nil {
+		return err
+	}
+
+	if removeExisting {
+		h = removeSignatures(h, domains)
+	}
+
+	var b bytes.Buffer
+	if err := writeHeader(&b, h); err != nil {
+		return err
+	}
+	return Sign(w, io.MultiReader(&b, br), options)
+}
+
+func removeSignatures(h header, domains []string) header {
+	var filtered header
+	for _, kv := range h {
+		k, v := parseHeaderField(kv)
+		if strings.EqualFold(k, headerFieldName) && matchSignatureDomain(v, domains) {
+			continue
+		}
+		filtered = append(filtered, kv)
+	}
+	return filtered
+}
+
+func matchSignatureDomain(sigValue string, domains []string) bool {
+	if len(domains) == 0 {
+		return true
+	}
+	params, err := parseHeaderParams(sigValue)
+	if err != nil {
+		return false
+	}
+	d := stripWhitespace(params["d"])
+	for _, domain := range domains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
 func formatSignature(params map[string]string) string {
 	sig := formatHeaderParams(headerFieldName, params)
 	return sig
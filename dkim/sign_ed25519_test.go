@@ -2,6 +2,9 @@ package dkim
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"math/rand"
 	"strings"
 	"testing"
@@ -67,3 +70,43 @@ func TestSignAndVerifyEd25519(t *testing.T) {
 		}
 	}
 }
+
+func TestSignEd25519_explicitHash(t *testing.T) {
+	r := strings.NewReader(mailString)
+	options := &SignOptions{
+		Domain:   "football.example.com",
+		Selector: "brisbane",
+		Signer:   testEd25519PrivateKey,
+		Hash:     crypto.SHA256,
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	if s := b.String(); s != signedEd25519MailString {
+		t.Errorf("Expected signed message to be \n%v\n but got \n%v", signedEd25519MailString, s)
+	}
+}
+
+func TestSign_unsupportedKeyAlgorithm(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.New(rand.NewSource(42)))
+	if err != nil {
+		t.Fatalf("Expected no error while generating key, got: %v", err)
+	}
+
+	options := &SignOptions{
+		Domain:   "example.org",
+		Selector: "brisbane",
+		Signer:   key,
+	}
+
+	var b bytes.Buffer
+	err = Sign(&b, strings.NewReader(mailString), options)
+	if err == nil {
+		t.Fatal("Expected an error when signing with an ECDSA key")
+	} else if !strings.Contains(err.Error(), "unsupported key algorithm") {
+		t.Errorf("Expected an unsupported key algorithm error, got: %v", err)
+	}
+}
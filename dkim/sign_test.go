@@ -1,11 +1,19 @@
 package dkim
 
 import (
+	"bufio"
 	"bytes"
 	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
 	"math/rand"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 const mailHeaderString = "From: Joe SixPack <joe@football.example.com>\r\n" +
@@ -108,6 +116,333 @@ func TestSignAndVerify_relaxed(t *testing.T) {
 	}
 }
 
+func TestSign_relaxedBodyVerbatim(t *testing.T) {
+	// Relaxed body canonicalization would collapse and strip this whitespace,
+	// and remove the trailing empty lines
+	body := "Hi  \t there. \r\n" +
+		"\r\n" +
+		"Joe.\t\r\n" +
+		"\r\n" +
+		"\r\n"
+	in := mailHeaderString + "\r\n" + body
+
+	options := &SignOptions{
+		Domain:                 "example.org",
+		Selector:               "brisbane",
+		Signer:                 testPrivateKey,
+		HeaderCanonicalization: CanonicalizationRelaxed,
+		BodyCanonicalization:   CanonicalizationRelaxed,
+	}
+	signFuncs := map[string]func(w io.Writer, r io.Reader) error{
+		"Sign": func(w io.Writer, r io.Reader) error {
+			return Sign(w, r, options)
+		},
+		"SignMultiple": func(w io.Writer, r io.Reader) error {
+			return SignMultiple(w, r, []*SignOptions{options})
+		},
+	}
+
+	for name, sign := range signFuncs {
+		t.Run(name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := sign(&b, strings.NewReader(in)); err != nil {
+				t.Fatal("Expected no error while signing mail, got:", err)
+			}
+
+			out := b.String()
+			if !strings.HasSuffix(out, in) {
+				t.Errorf("Expected original message to be copied verbatim, got: \n%q", out)
+			}
+
+			verifications, err := Verify(&b)
+			if err != nil {
+				t.Fatalf("Expected no error while verifying signature, got: %v", err)
+			} else if len(verifications) != 1 {
+				t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+			} else if err := verifications[0].Err; err != nil {
+				t.Errorf("Expected no error when verifying signature, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestSignAndVerify_canonicalizations(t *testing.T) {
+	// Trailing whitespace and empty lines make each canonicalization produce
+	// a different result
+	mail := mailHeaderString + "\r\n" + "Hi.  \t\r\n\r\nWe  lost\tthe game. \r\n\r\n\r\n"
+
+	cans := []Canonicalization{CanonicalizationSimple, CanonicalizationRelaxed}
+	for _, headerCan := range cans {
+		for _, bodyCan := range cans {
+			c := string(headerCan) + "/" + string(bodyCan)
+			t.Run(c, func(t *testing.T) {
+				options := &SignOptions{
+					Domain:                 "example.org",
+					Selector:               "brisbane",
+					Signer:                 testPrivateKey,
+					HeaderCanonicalization: headerCan,
+					BodyCanonicalization:   bodyCan,
+				}
+
+				var b bytes.Buffer
+				if err := Sign(&b, strings.NewReader(mail), options); err != nil {
+					t.Fatal("Expected no error while signing mail, got:", err)
+				}
+
+				h, err := readHeader(bufio.NewReader(bytes.NewReader(b.Bytes())))
+				if err != nil {
+					t.Fatalf("Expected no error while reading signed header, got: %v", err)
+				}
+				_, v := parseHeaderField(h[0])
+				params, err := parseHeaderParams(v)
+				if err != nil {
+					t.Fatalf("Expected no error while parsing signature, got: %v", err)
+				}
+				if got := stripWhitespace(params["c"]); got != c {
+					t.Errorf("Expected c=%v, got c=%v", c, got)
+				}
+
+				// The body hash must match the advertised body canonicalization
+				_, canonBody, err := CanonicalizeMessage(strings.NewReader(mail), nil, headerCan, bodyCan)
+				if err != nil {
+					t.Fatalf("Expected no error while canonicalizing message, got: %v", err)
+				}
+				sum := sha256.Sum256(canonBody)
+				if bh := stripWhitespace(params["bh"]); bh != base64.StdEncoding.EncodeToString(sum[:]) {
+					t.Errorf("Body hash doesn't match %v body canonicalization", bodyCan)
+				}
+
+				verifications, err := Verify(&b)
+				if err != nil {
+					t.Fatalf("Expected no error while verifying signature, got: %v", err)
+				} else if len(verifications) != 1 {
+					t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+				} else if err := verifications[0].Err; err != nil {
+					t.Errorf("Expected no error while verifying signature, got: %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestSignAndVerify_encodedIdentifier(t *testing.T) {
+	r := strings.NewReader(mailString)
+	options := &SignOptions{
+		Domain:     "example.org",
+		Selector:   "brisbane",
+		Signer:     testPrivateKey,
+		Identifier: "joe six;pack@example.org",
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+	if !strings.Contains(b.String(), "i=joe=20six=3Bpack@example.org;") {
+		t.Errorf("Expected identifier to be quoted-printable encoded in:\n%v", b.String())
+	}
+
+	verifications, err := Verify(&b)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+	v := verifications[0]
+	if v.Err != nil {
+		t.Errorf("Expected no error while verifying signature, got: %v", v.Err)
+	}
+	if v.Identifier != options.Identifier {
+		t.Errorf("Expected identifier to be %q, got %q", options.Identifier, v.Identifier)
+	}
+}
+
+func TestDecodeQuotedPrintable(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"joe@example.org", "joe@example.org", true},
+		{"joe=20six@example.org", "joe six@example.org", true},
+		{"joe=3b=3D\r\n\tx@example.org", "joe;=x@example.org", true},
+		{"joe=2", "", false},
+		{"joe=zz@example.org", "", false},
+	}
+	for _, test := range tests {
+		got, err := decodeQuotedPrintable(test.in)
+		if test.ok && err != nil {
+			t.Errorf("decodeQuotedPrintable(%q) = %v", test.in, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("Expected an error for decodeQuotedPrintable(%q)", test.in)
+		} else if got != test.want {
+			t.Errorf("decodeQuotedPrintable(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestSign_hashAlgorithm(t *testing.T) {
+	tests := []struct {
+		algo string
+		hash crypto.Hash
+		ok   bool
+	}{
+		{"sha256", 0, true},
+		{"SHA256", 0, true},
+		{"sha256", crypto.SHA256, true},
+		{"sha256", crypto.SHA512, false},
+		{"sha1", 0, false},
+		{"md5", 0, false},
+	}
+
+	for _, test := range tests {
+		options := &SignOptions{
+			Domain:        "example.org",
+			Selector:      "brisbane",
+			Signer:        testPrivateKey,
+			Hash:          test.hash,
+			HashAlgorithm: test.algo,
+		}
+
+		var b bytes.Buffer
+		err := Sign(&b, strings.NewReader(mailString), options)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("Expected an error while signing with hash algorithm %q and hash %v", test.algo, test.hash)
+			} else if test.hash == 0 && !strings.Contains(err.Error(), "unknown hash algorithm") {
+				t.Errorf("Expected an unknown hash algorithm error for %q, got: %v", test.algo, err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("Expected no error while signing with hash algorithm %q, got: %v", test.algo, err)
+			continue
+		}
+
+		verifications, err := Verify(&b)
+		if err != nil {
+			t.Fatalf("Expected no error while verifying signature, got: %v", err)
+		} else if len(verifications) != 1 {
+			t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+		}
+		if v := verifications[0]; v.Err != nil {
+			t.Errorf("Expected no error when verifying signature, got: %v", v.Err)
+		} else if v.Algorithm != "rsa-sha256" {
+			t.Errorf("Expected algorithm to be rsa-sha256, got %v", v.Algorithm)
+		}
+	}
+}
+
+func TestSign_bodyLengthTooLarge(t *testing.T) {
+	_, canonBody, err := CanonicalizeMessage(strings.NewReader(mailString), nil, CanonicalizationSimple, CanonicalizationSimple)
+	if err != nil {
+		t.Fatalf("Expected no error while canonicalizing message, got: %v", err)
+	}
+
+	options := &SignOptions{
+		Domain:     "example.org",
+		Selector:   "brisbane",
+		Signer:     testPrivateKey,
+		BodyLength: int64(len(canonBody)),
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, strings.NewReader(mailString), options); err != nil {
+		t.Errorf("Expected no error while signing the whole body with l=, got: %v", err)
+	}
+
+	options.BodyLength++
+	b.Reset()
+	if err := Sign(&b, strings.NewReader(mailString), options); err == nil {
+		t.Error("Expected an error while signing with a body length larger than the body")
+	}
+}
+
+func TestSignAndVerify_controlBytesBody(t *testing.T) {
+	body := "Hi.\r\n" +
+		"\x00\x01\x02\x1b[0m\x7f \x00\t\x00\r\n" +
+		"\xff\xfe\x00\x00 Joe.\r\n"
+
+	for _, can := range []Canonicalization{CanonicalizationSimple, CanonicalizationRelaxed} {
+		t.Run(string(can), func(t *testing.T) {
+			options := &SignOptions{
+				Domain:                 "example.org",
+				Selector:               "brisbane",
+				Signer:                 testPrivateKey,
+				HeaderCanonicalization: can,
+				BodyCanonicalization:   can,
+			}
+
+			var b bytes.Buffer
+			if err := Sign(&b, strings.NewReader(mailHeaderString+"\r\n"+body), options); err != nil {
+				t.Fatal("Expected no error while signing mail, got:", err)
+			}
+			signed := b.String()
+			if !strings.HasSuffix(signed, "\r\n"+body) {
+				t.Fatalf("Expected the body to be left untouched")
+			}
+
+			verifications, err := Verify(strings.NewReader(signed))
+			if err != nil {
+				t.Fatalf("Expected no error while verifying signature, got: %v", err)
+			} else if len(verifications) != 1 {
+				t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+			} else if err := verifications[0].Err; err != nil {
+				t.Errorf("Expected no error while verifying signature, got: %v", err)
+			}
+
+			// Bytes after the NULs must be covered by the body hash
+			tampered := strings.Replace(signed, "Joe.", "Jim.", 1)
+			verifications, err = Verify(strings.NewReader(tampered))
+			if err != nil {
+				t.Fatalf("Expected no error while verifying signature, got: %v", err)
+			} else if len(verifications) != 1 {
+				t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+			} else if verifications[0].Err == nil {
+				t.Errorf("Expected an error while verifying a tampered body")
+			}
+		})
+	}
+}
+
+func TestSignAndVerify_nonASCIIHeader(t *testing.T) {
+	subjects := map[string]string{
+		"raw UTF-8":    "Subject: Le dîner est prêt ? \u00a0🍲\r\n",
+		"encoded-word": "Subject: =?UTF-8?Q?Le_d=C3=AEner_est_pr=C3=AAt_=3F?=\r\n",
+		"8-bit":        "Subject: Le d\xeener  est pr\xeat\t?\r\n",
+	}
+
+	for name, subject := range subjects {
+		for _, can := range []Canonicalization{CanonicalizationSimple, CanonicalizationRelaxed} {
+			t.Run(name+"/"+string(can), func(t *testing.T) {
+				mail := strings.Replace(mailString, "Subject: Is dinner ready?\r\n", subject, 1)
+				options := &SignOptions{
+					Domain:                 "example.org",
+					Selector:               "brisbane",
+					Signer:                 testPrivateKey,
+					HeaderCanonicalization: can,
+					BodyCanonicalization:   can,
+				}
+
+				var b bytes.Buffer
+				if err := Sign(&b, strings.NewReader(mail), options); err != nil {
+					t.Fatal("Expected no error while signing mail, got:", err)
+				}
+				if !strings.Contains(b.String(), subject) {
+					t.Fatalf("Expected the Subject header field to be left untouched")
+				}
+
+				verifications, err := Verify(&b)
+				if err != nil {
+					t.Fatalf("Expected no error while verifying signature, got: %v", err)
+				} else if len(verifications) != 1 {
+					t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+				} else if err := verifications[0].Err; err != nil {
+					t.Errorf("Expected no error while verifying signature, got: %v", err)
+				}
+			})
+		}
+	}
+}
+
 func TestSign_invalidOptions(t *testing.T) {
 	r := strings.NewReader(mailString)
 	var b bytes.Buffer
@@ -162,3 +497,551 @@ func TestSign_invalidOptions(t *testing.T) {
 	}
 	options.HeaderKeys = nil
 }
+
+func TestSign_existingSignatures(t *testing.T) {
+	tests := []struct {
+		name string
+		mail string
+		want []string
+	}{
+		{"unsigned", mailString, nil},
+		{"signed", signedMailString, []string{"example.org"}},
+		{"malformed", "DKIM-Signature: garbage\r\n" + signedMailString, []string{"", "example.org"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			options := &SignOptions{
+				Domain:   "example.com",
+				Selector: "brisbane",
+				Signer:   testPrivateKey,
+				ExistingSignatures: func(domains []string) {
+					got = append(got, domains...)
+				},
+			}
+
+			var b bytes.Buffer
+			if err := Sign(&b, strings.NewReader(test.mail), options); err != nil {
+				t.Fatal("Expected no error while signing mail, got:", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Sign: expected existing signatures %q, got %q", test.want, got)
+			}
+
+			got = nil
+			if err := SignMultiple(&b, strings.NewReader(test.mail), []*SignOptions{options}); err != nil {
+				t.Fatal("Expected no error while signing mail, got:", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("SignMultiple: expected existing signatures %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestResign(t *testing.T) {
+	r := strings.NewReader(signedMailString)
+	options := &SignOptions{
+		Domain:   "example.com",
+		Selector: "brisbane",
+		Signer:   testPrivateKey,
+	}
+
+	var b bytes.Buffer
+	if err := Resign(&b, r, options, true); err != nil {
+		t.Fatal("Expected no error while re-signing mail, got:", err)
+	}
+
+	verifications, err := Verify(&b)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	}
+	if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+	v := verifications[0]
+	if err := v.Err; err != nil {
+		t.Errorf("Expected no error when verifying signature, got: %v", err)
+	}
+	if v.Domain != options.Domain {
+		t.Errorf("Expected domain to be %q but got %q", options.Domain, v.Domain)
+	}
+	for _, k := range v.HeaderKeys {
+		if strings.EqualFold(k, headerFieldName) {
+			t.Errorf("Expected removed signature not to be signed")
+		}
+	}
+}
+
+func TestResign_otherDomain(t *testing.T) {
+	r := strings.NewReader(signedMailString)
+	options := &SignOptions{
+		Domain:     "example.com",
+		Selector:   "brisbane",
+		Signer:     testPrivateKey,
+		HeaderKeys: []string{"From", "To", "Subject"},
+	}
+
+	var b bytes.Buffer
+	if err := Resign(&b, r, options, true, "example.net"); err != nil {
+		t.Fatal("Expected no error while re-signing mail, got:", err)
+	}
+
+	verifications, err := Verify(&b)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	}
+	if len(verifications) != 2 {
+		t.Fatalf("Expected exactly two verifications, got %v", len(verifications))
+	}
+}
+
+func TestSignAndVerify_queryMethodOptions(t *testing.T) {
+	r := strings.NewReader(mailString)
+	options := &SignOptions{
+		Domain:       "example.org",
+		Selector:     "brisbane",
+		Signer:       testPrivateKey,
+		QueryMethods: []QueryMethod{"dns/txt/foo"},
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	verifications, err := Verify(&b)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	}
+	if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+	if err := verifications[0].Err; err != nil {
+		t.Errorf("Expected no error when verifying signature, got: %v", err)
+	}
+}
+
+const mimeMailString = "From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed;\r\n" +
+	"  boundary=\"=_a; b=c \\\"quoted\\\"\"\r\n" +
+	"\r\n" +
+	"--=_a; b=c \"quoted\"\r\n" +
+	"Content-Type: text/plain; charset=\"utf-8\"\r\n" +
+	"\r\n" +
+	"We lost the game. Are you hungry yet?\r\n" +
+	"--=_a; b=c \"quoted\"--\r\n"
+
+func TestSignAndVerify_mimeHeaders(t *testing.T) {
+	for _, can := range []Canonicalization{CanonicalizationSimple, CanonicalizationRelaxed} {
+		r := strings.NewReader(mimeMailString)
+		options := &SignOptions{
+			Domain:                 "example.org",
+			Selector:               "brisbane",
+			Signer:                 testPrivateKey,
+			HeaderCanonicalization: can,
+			BodyCanonicalization:   can,
+			HeaderKeys:             []string{"From", "To", "Subject", "MIME-Version", "Content-Type"},
+		}
+
+		var b bytes.Buffer
+		if err := Sign(&b, r, options); err != nil {
+			t.Fatalf("Expected no error while signing mail with %v canonicalization, got: %v", can, err)
+		}
+
+		verifications, err := Verify(&b)
+		if err != nil {
+			t.Fatalf("Expected no error while verifying signature with %v canonicalization, got: %v", can, err)
+		}
+		if len(verifications) != 1 {
+			t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+		}
+		if err := verifications[0].Err; err != nil {
+			t.Errorf("Expected no error when verifying signature with %v canonicalization, got: %v", can, err)
+		}
+	}
+}
+
+func TestSignAndVerify_relaxedBodyLength(t *testing.T) {
+	// Trailing empty lines are removed by the relaxed body canonicalization,
+	// so they must not be counted in the body length
+	var canonical bytes.Buffer
+	wc := new(relaxedCanonicalizer).CanonicalizeBody(&canonical)
+	if _, err := io.WriteString(wc, mailBodyString+"\r\n\r\n\r\n"); err != nil {
+		t.Fatal("Expected no error while canonicalizing body, got:", err)
+	}
+	if err := wc.Close(); err != nil {
+		t.Fatal("Expected no error while canonicalizing body, got:", err)
+	}
+
+	r := strings.NewReader(mailString + "\r\n\r\n\r\n")
+	options := &SignOptions{
+		Domain:                 "example.org",
+		Selector:               "brisbane",
+		Signer:                 testPrivateKey,
+		HeaderCanonicalization: CanonicalizationRelaxed,
+		BodyCanonicalization:   CanonicalizationRelaxed,
+		BodyLength:             int64(canonical.Len()),
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+	b.WriteString("--\r\nThis footer was added by a mailing list.\r\n")
+
+	verifications, err := VerifyWithOptions(&b, &VerifyOptions{AllowBodyLength: true})
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	}
+	if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+	if err := verifications[0].Err; err != nil {
+		t.Errorf("Expected no error when verifying signature, got: %v", err)
+	}
+}
+
+func TestSignAndVerify_bodyLengthNotAllowed(t *testing.T) {
+	r := strings.NewReader(mailString)
+	options := &SignOptions{
+		Domain:     "example.org",
+		Selector:   "brisbane",
+		Signer:     testPrivateKey,
+		BodyLength: 4,
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	verifications, err := Verify(&b)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	}
+	if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+	if verifications[0].Err == nil {
+		t.Errorf("Expected an error when verifying a signature with a body length tag")
+	}
+}
+
+func TestSign_insertAfter(t *testing.T) {
+	received := "Received: from a.example.org\r\n" +
+		"Received: from b.example.org\r\n"
+	r := strings.NewReader(received + mailString)
+	options := &SignOptions{
+		Domain:      "example.org",
+		Selector:    "brisbane",
+		Signer:      testPrivateKey,
+		HeaderKeys:  []string{"From", "To", "Subject"},
+		InsertAfter: "Received",
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	s := b.String()
+	if !strings.HasPrefix(s, received+"DKIM-Signature: ") {
+		t.Errorf("Expected signature to be inserted after the last Received header field, got: \n%v", s)
+	}
+	if !strings.HasSuffix(s, mailString) {
+		t.Errorf("Expected message to be preserved after the signature, got: \n%v", s)
+	}
+
+	verifications, err := Verify(&b)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	}
+	if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+	if err := verifications[0].Err; err != nil {
+		t.Errorf("Expected no error when verifying signature, got: %v", err)
+	}
+}
+
+func TestSignAndVerify_bom(t *testing.T) {
+	const bom = "\xEF\xBB\xBF"
+
+	options := &SignOptions{
+		Domain:   "example.org",
+		Selector: "brisbane",
+		Signer:   testPrivateKey,
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, strings.NewReader(bom+mailString), options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+	signed := b.String()
+	if strings.Contains(signed, bom) {
+		t.Errorf("Expected byte order mark to be removed, got: \n%q", signed)
+	}
+
+	// A byte order mark added after signing must be ignored as well
+	for _, s := range []string{signed, bom + signed} {
+		verifications, err := Verify(strings.NewReader(s))
+		if err != nil {
+			t.Fatalf("Expected no error while verifying signature, got: %v", err)
+		} else if len(verifications) != 1 {
+			t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+		} else if err := verifications[0].Err; err != nil {
+			t.Errorf("Expected no error when verifying signature, got: %v", err)
+		}
+	}
+}
+
+// hasBareLF reports whether s contains a LF not preceded by a CR.
+func hasBareLF(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\n' && (i == 0 || s[i-1] != '\r') {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSign_crlf(t *testing.T) {
+	lfMailString := strings.ReplaceAll(mailString, "\r\n", "\n")
+	options := &SignOptions{
+		Domain:     "example.org",
+		Selector:   "brisbane",
+		Identifier: "joe@football.example.com",
+		Signer:     testPrivateKey,
+		// Many header keys, so that the signature field gets folded
+		HeaderKeys:  []string{"From", "To", "Subject", "Date", "Message-ID", "Reply-To", "Cc", "In-Reply-To", "References"},
+		InsertAfter: "Message-ID",
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, strings.NewReader(lfMailString), options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	// The header is re-written when inserting the signature
+	s := b.String()
+	header, _, ok := strings.Cut(s, "\r\n\r\n")
+	if !ok {
+		t.Fatalf("Expected header to end with CRLF CRLF, got: \n%q", s)
+	}
+	if hasBareLF(header) {
+		t.Errorf("Expected no bare LF in header, got: \n%q", header)
+	}
+
+	_, sig, _ := strings.Cut(header, "DKIM-Signature:")
+	if !strings.Contains(sig, "\r\n ") {
+		t.Errorf("Expected signature to be folded, got: \n%q", sig)
+	}
+
+	options.InsertAfter = ""
+	signer, err := NewSigner(options)
+	if err != nil {
+		t.Fatal("Expected no error while creating signer, got:", err)
+	}
+	if _, err := io.WriteString(signer, lfMailString); err != nil {
+		t.Fatal("Expected no error while writing to signer, got:", err)
+	}
+	if err := signer.Close(); err != nil {
+		t.Fatal("Expected no error while closing signer, got:", err)
+	}
+	if sig := signer.Signature(); hasBareLF(sig) || !strings.HasSuffix(sig, "\r\n") {
+		t.Errorf("Expected signature to only use CRLF line endings, got: \n%q", sig)
+	}
+}
+
+func TestSignMultiple_bodyLength(t *testing.T) {
+	r := strings.NewReader(mailString)
+	options := []*SignOptions{
+		{
+			Domain:     "example.org",
+			Selector:   "brisbane",
+			Signer:     testPrivateKey,
+			BodyLength: 4,
+		},
+		{
+			Domain:   "example.org",
+			Selector: "brisbane",
+			Signer:   testPrivateKey,
+		},
+	}
+
+	var b bytes.Buffer
+	if err := SignMultiple(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	verifications, err := VerifyWithOptions(&b, &VerifyOptions{AllowBodyLength: true})
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	}
+	if len(verifications) != 2 {
+		t.Fatalf("Expected exactly two verifications, got %v", len(verifications))
+	}
+	for i, v := range verifications {
+		if err := v.Err; err != nil {
+			t.Errorf("Expected no error when verifying signature #%v, got: %v", i, err)
+		}
+	}
+	if !verifications[0].PartialBody {
+		t.Errorf("Expected signature with a body length to sign a partial body")
+	}
+	if l := verifications[0].BodyLength; l != 4 {
+		t.Errorf("Expected body length to be 4 but got %v", l)
+	}
+	if verifications[1].PartialBody {
+		t.Errorf("Expected signature without a body length to sign the whole body")
+	}
+}
+
+func TestSign_freezeTimestamp(t *testing.T) {
+	calls := 0
+	options := FreezeTimestamp(&SignOptions{
+		Domain:   "example.org",
+		Selector: "brisbane",
+		Signer:   testPrivateKey,
+		Now: func() time.Time {
+			calls++
+			return time.Unix(int64(1000000+calls), 0)
+		},
+	})
+
+	var timestamps []string
+	for i := 0; i < 2; i++ {
+		var b bytes.Buffer
+		if err := Sign(&b, strings.NewReader(mailString), options); err != nil {
+			t.Fatal("Expected no error while signing mail, got:", err)
+		}
+
+		verifications, err := Verify(&b)
+		if err != nil {
+			t.Fatalf("Expected no error while verifying signature, got: %v", err)
+		} else if len(verifications) != 1 {
+			t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+		}
+		timestamps = append(timestamps, formatTime(verifications[0].Time))
+	}
+
+	if calls != 1 {
+		t.Errorf("Expected the current time to be retrieved once, got %v", calls)
+	}
+	if timestamps[0] != "1000001" || timestamps[1] != timestamps[0] {
+		t.Errorf("Expected both signatures to have the same timestamp, got %v", timestamps)
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(testEd25519PrivateKey)
+	if err != nil {
+		t.Fatalf("Expected no error while marshaling private key, got: %v", err)
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})
+
+	k, err := ParsePrivateKey(b)
+	if err != nil {
+		t.Fatalf("Expected no error while parsing PKCS#8 Ed25519 private key, got: %v", err)
+	}
+	if !reflect.DeepEqual(k.Public(), testEd25519PrivateKey.Public()) {
+		t.Errorf("Expected parsed private key to match")
+	}
+
+	if _, err := ParsePrivateKey([]byte(testPrivateKeyPEM)); err != nil {
+		t.Errorf("Expected no error while parsing PKCS#1 RSA private key, got: %v", err)
+	}
+}
+
+func TestParsePrivateKey_openSSH(t *testing.T) {
+	b := pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: []byte("openssh-key-v1")})
+	_, err := ParsePrivateKey(b)
+	if err == nil {
+		t.Fatalf("Expected an error while parsing an OpenSSH private key")
+	} else if !strings.Contains(err.Error(), "PKCS8") {
+		t.Errorf("Expected error to explain how to convert the key, got: %v", err)
+	}
+}
+
+func TestSign_missingBody(t *testing.T) {
+	options := &SignOptions{
+		Domain:   "example.org",
+		Selector: "brisbane",
+		Signer:   testPrivateKey,
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, strings.NewReader(mailHeaderString), options); err == nil {
+		t.Fatal("Expected an error while signing a message without a body")
+	}
+
+	options.AllowMissingBody = true
+	b.Reset()
+	if err := Sign(&b, strings.NewReader(mailHeaderString), options); err != nil {
+		t.Fatal("Expected no error while signing a message without a body, got:", err)
+	}
+
+	// Empty body hash with the simple body canonicalization
+	if s := b.String(); !strings.Contains(s, "bh=frcCV1k9oG9oKj3dpUqdJg1PxRT2RSN/XKdLCPjaYaY=;") {
+		t.Errorf("Expected signature to contain the empty body hash, got: \n%v", s)
+	}
+
+	if s := b.String(); !strings.HasSuffix(s, mailHeaderString+"\r\n") {
+		t.Errorf("Expected the header to be terminated by an empty line, got: \n%v", s)
+	}
+
+	verifications, err := Verify(&b)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+	if err := verifications[0].Err; err != nil {
+		t.Errorf("Expected no error when verifying signature, got: %v", err)
+	}
+}
+
+func TestSign_missingBodyUnterminated(t *testing.T) {
+	options := &SignOptions{
+		Domain:           "example.org",
+		Selector:         "brisbane",
+		Signer:           testPrivateKey,
+		AllowMissingBody: true,
+	}
+	mail := strings.TrimSuffix(mailHeaderString, "\r\n")
+
+	sign := map[string]func(w io.Writer, r io.Reader) error{
+		"Sign": func(w io.Writer, r io.Reader) error {
+			return Sign(w, r, options)
+		},
+		"SignMultiple": func(w io.Writer, r io.Reader) error {
+			return SignMultiple(w, r, []*SignOptions{options})
+		},
+	}
+	for name, sign := range sign {
+		t.Run(name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := sign(&b, strings.NewReader(mail)); err != nil {
+				t.Fatal("Expected no error while signing a message without a body, got:", err)
+			}
+			if s := b.String(); !strings.HasSuffix(s, mail+"\r\n\r\n") {
+				t.Errorf("Expected the header to be terminated by an empty line, got: \n%v", s)
+			}
+
+			verifications, err := Verify(&b)
+			if err != nil {
+				t.Fatalf("Expected no error while verifying signature, got: %v", err)
+			} else if len(verifications) != 1 {
+				t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+			}
+			if err := verifications[0].Err; err != nil {
+				t.Errorf("Expected no error when verifying signature, got: %v", err)
+			}
+		})
+	}
+}
@@ -2,18 +2,27 @@ package dkim
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto"
 	"crypto/subtle"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/mail"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
-	"unicode"
+
+	"github.com/emersion/go-msgauth/authres"
 )
 
 type permFailError string
@@ -59,6 +68,12 @@ func isFail(err error) bool {
 // maximum number of signatures.
 var ErrTooManySignatures = errors.New("dkim: too many signatures")
 
+// ErrKeyRevoked is the error of a verification whose public key has been
+// revoked, i.e. published with an empty "p" tag. It's a permanent failure.
+var ErrKeyRevoked error = permFailError("key revoked")
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
 var requiredTags = []string{"v", "a", "b", "bh", "d", "h", "s"}
 
 // A Verification is produced by Verify when it checks if one signature is
@@ -70,19 +85,168 @@ type Verification struct {
 	// The Agent or User Identifier (AUID) on behalf of which the SDID is taking
 	// responsibility.
 	Identifier string
+	// The selector used to look up the public key.
+	Selector string
+	// The signing algorithm, e.g. "rsa-sha256".
+	Algorithm string
 
 	// The list of signed header fields.
 	HeaderKeys []string
+	// How the From header field is covered by the signature.
+	From FromCoverage
+
+	// Whether the signature has a body length tag, in which case it may only
+	// cover part of the message body.
+	PartialBody bool
+	// The number of canonicalized body bytes covered by the signature, if
+	// PartialBody is set.
+	BodyLength int64
+
+	// Whether only the header signature was verified, because
+	// VerifyOptions.SkipBodyHash is set. The message body may have been
+	// modified after signing.
+	HeaderOnly bool
 
 	// The time that this signature was created. If unknown, it's set to zero.
 	Time time.Time
 	// The expiration time. If the signature doesn't expire, it's set to zero.
+	// The signature is still valid at the expiration time, and has expired
+	// afterwards.
 	Expiration time.Time
 
+	// Signed header field names which have more instances in the message than
+	// were hashed. The extra instances aren't covered by the signature and
+	// may have been added after signing.
+	UnsignedHeaderKeys []string
+
+	// The header field instances picked for each entry of HeaderKeys. Only
+	// populated if VerifyOptions.HeaderInstances is set.
+	HeaderInstances []HeaderInstance
+
+	// The DKIM-Signature header field value, as found in the message.
+	Signature string
+
+	// The public key record used to verify the signature. It's nil if the key
+	// couldn't be retrieved. Its Flags can be checked to find out whether the
+	// signing domain is testing DKIM.
+	PublicKey *PublicKey
+
 	// Err is nil if the signature is valid.
 	Err error
 }
 
+// FromCoverage describes how the From header field is covered by a signature.
+type FromCoverage struct {
+	// The number of times From is listed in the signed header fields.
+	Signed int
+	// The number of From header fields present in the message.
+	Present int
+	// Oversigned is true if From is listed more times than it's present,
+	// which prevents additional From header fields from being added without
+	// breaking the signature.
+	Oversigned bool
+}
+
+// A HeaderInstance is a header field instance used to compute a signature.
+type HeaderInstance struct {
+	// The header field name, as listed in the signature.
+	Key string
+	// The index of the header field in the message header, starting from the
+	// top. If the message has no matching header field, it's set to -1.
+	Index int
+}
+
+type jsonVerification struct {
+	Domain     string     `json:"domain"`
+	Identifier string     `json:"identifier"`
+	Selector   string     `json:"selector"`
+	Algorithm  string     `json:"algorithm"`
+	HeaderKeys []string   `json:"header_keys"`
+	BodyLength *int64     `json:"body_length,omitempty"`
+	Time       *time.Time `json:"time,omitempty"`
+	Expiration *time.Time `json:"expiration,omitempty"`
+	Signature  string     `json:"signature,omitempty"`
+	Result     string     `json:"result"`
+	Err        string     `json:"error,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler. The result is one of "pass", "fail",
+// "permerror" or "temperror", and the error is serialized as a string. The
+// body length is only included if the signature has a body length tag.
+func (v *Verification) MarshalJSON() ([]byte, error) {
+	jv := jsonVerification{
+		Domain:     v.Domain,
+		Identifier: v.Identifier,
+		Selector:   v.Selector,
+		Algorithm:  v.Algorithm,
+		HeaderKeys: v.HeaderKeys,
+		Signature:  v.Signature,
+		Result:     "pass",
+	}
+	if v.PartialBody {
+		jv.BodyLength = &v.BodyLength
+	}
+	if !v.Time.IsZero() {
+		jv.Time = &v.Time
+	}
+	if !v.Expiration.IsZero() {
+		jv.Expiration = &v.Expiration
+	}
+	if v.Err != nil {
+		jv.Err = v.Err.Error()
+		jv.Result = string(resultValue(v.Err))
+	}
+	return json.Marshal(&jv)
+}
+
+// String returns a short human-readable summary of the verification, suitable
+// for logging.
+func (v *Verification) String() string {
+	s := fmt.Sprintf("%v for %v (selector %v, algorithm %v)", resultValue(v.Err), v.Domain, v.Selector, v.Algorithm)
+	if v.Err != nil {
+		s += ": " + v.Err.Error()
+	}
+	return s
+}
+
+// AuthResult converts the verification into a DKIM result suitable for an
+// Authentication-Results header field. If identity is non-empty, it's used
+// as the reported identifier ("header.i") instead of the verification's.
+func (v *Verification) AuthResult(identity string) *authres.DKIMResult {
+	res := &authres.DKIMResult{
+		Value:      resultValue(v.Err),
+		Domain:     v.Domain,
+		Identifier: v.Identifier,
+		Selector:   v.Selector,
+	}
+	if identity != "" {
+		res.Identifier = identity
+	}
+	if v.Err != nil {
+		res.Reason = strings.TrimPrefix(v.Err.Error(), "dkim: ")
+	}
+	return res
+}
+
+// NoSignatureResult returns the DKIM result for a message which doesn't have
+// any DKIM signature, as defined in RFC 8601 section 2.7.1.
+func NoSignatureResult() *authres.DKIMResult {
+	return &authres.DKIMResult{Value: authres.ResultNone}
+}
+
+func resultValue(err error) authres.ResultValue {
+	switch {
+	case err == nil:
+		return authres.ResultPass
+	case IsPermFail(err):
+		return authres.ResultPermError
+	case IsTempFail(err):
+		return authres.ResultTempError
+	default:
+		return authres.ResultFail
+	}
+}
+
 type signature struct {
 	i int
 	v string
@@ -94,16 +258,71 @@ type VerifyOptions struct {
 	// LookupTXT returns the DNS TXT records for the given domain name. If nil,
 	// net.LookupTXT is used.
 	LookupTXT func(domain string) ([]string, error)
+	// LookupTXTContext is like LookupTXT, but takes the context passed to
+	// VerifyWithContext, e.g. net.Resolver.LookupTXT. If non-nil, it's used
+	// instead of LookupTXT.
+	LookupTXTContext func(ctx context.Context, domain string) ([]string, error)
+	// LookupCNAME returns the canonical name for the given domain name. If
+	// non-nil, it's used to follow CNAME records when a DNS TXT key lookup
+	// yields no records, for resolvers which don't do it themselves.
+	// net.LookupCNAME can be used. It doesn't receive the context passed to
+	// VerifyWithContext.
+	LookupCNAME func(domain string) (string, error)
 	// MaxVerifications controls the maximum number of signature verifications
 	// to perform. If more signatures are present, the first MaxVerifications
 	// signatures are verified, the rest are ignored and ErrTooManySignatures
 	// is returned. If zero, there is no maximum.
 	MaxVerifications int
+	// AutoDecompress enables transparent decompression of gzip-compressed
+	// messages. If the message starts with the gzip magic number, it is
+	// decompressed before being verified.
+	AutoDecompress bool
+	// Now returns the current time, used to check signature expiration. If
+	// nil, time.Now is used.
+	Now func() time.Time
+	// HeaderInstances enables reporting which header field instances were
+	// hashed in Verification.HeaderInstances.
+	HeaderInstances bool
+	// MaxValidityWindow is the maximum duration between the creation time and
+	// the expiration time of a signature. Signatures which have both and
+	// exceed it fail to verify. If zero, there is no maximum.
+	MaxValidityWindow time.Duration
+	// QueryMethods registers additional public key query methods, or
+	// overrides built-in ones such as QueryMethodDNSTXT. The methods listed in
+	// the "q" tag of a signature are tried in order, and the first supported
+	// one is used. If the tag is absent, QueryMethodDNSTXT is used.
+	QueryMethods map[QueryMethod]QueryFunc
+	// RequireSignedHeaders is a list of header field names which must be
+	// signed, in addition to From. Signatures which don't sign all of them
+	// fail to verify.
+	RequireSignedHeaders []string
+	// AllowBodyLength enables verification of signatures with a body length
+	// tag. Such signatures only cover part of the message body, so content
+	// can be appended without breaking them. If false, they fail to verify.
+	AllowBodyLength bool
+	// SkipBodyHash disables the body hash check: only the signature over the
+	// header fields is verified, and Verification.HeaderOnly is set. This is
+	// not standard DKIM verification, since the body may have been modified
+	// after signing. It's meant for systems which only need to know whether
+	// the header was signed by the domain, e.g. for reputation purposes.
+	SkipBodyHash bool
+	// MaxHeaderSize limits the size of the message header, in bytes. If the
+	// header is larger, ErrHeaderTooLarge is returned. If zero, there is no
+	// limit.
+	MaxHeaderSize int
+	// MaxDNSLookups limits the total number of public key lookups performed
+	// for a message, across all signatures. Once the limit is reached, the
+	// remaining signatures fail with a temporary failure. If zero, there is
+	// no limit.
+	MaxDNSLookups int
 }
 
 // Verify checks if a message's signatures are valid. It returns one
 // verification per signature.
 //
+// If the message has no DKIM signature, an empty slice and a nil error are
+// returned. The DKIM result for such a message is NoSignatureResult.
+//
 // There is no guarantee that the reader will be completely consumed.
 func Verify(r io.Reader) ([]*Verification, error) {
 	return VerifyWithOptions(r, nil)
@@ -112,21 +331,42 @@ func Verify(r io.Reader) ([]*Verification, error) {
 // VerifyWithOptions performs the same task as Verify, but allows specifying
 // verification options.
 func VerifyWithOptions(r io.Reader, options *VerifyOptions) ([]*Verification, error) {
-	// Read header
-	bufr := bufio.NewReader(r)
-	h, err := readHeader(bufr)
+	return VerifyWithContext(context.Background(), r, options)
+}
+
+// VerifyWithContext performs the same task as VerifyWithOptions, but stops
+// verifying when ctx is cancelled, in which case the context error is
+// returned. The context is passed to VerifyOptions.LookupTXTContext. If
+// neither LookupTXTContext nor LookupTXT is set, net.DefaultResolver is used
+// with the context.
+//
+// VerifyOptions.LookupTXT, VerifyOptions.LookupCNAME and custom query methods
+// don't receive the context: they aren't interrupted on cancellation, but
+// aren't called anymore once the context is done.
+func VerifyWithContext(ctx context.Context, r io.Reader, options *VerifyOptions) ([]*Verification, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ctx.Done() != nil {
+		r = &contextReader{ctx, r}
+	}
+
+	bufr, closer, err := newVerifyReader(r, options)
 	if err != nil {
 		return nil, err
 	}
+	if closer != nil {
+		defer closer.Close()
+	}
 
-	// Scan header fields for signatures
-	var signatures []*signature
-	for i, kv := range h {
-		k, v := parseHeaderField(kv)
-		if strings.EqualFold(k, headerFieldName) {
-			signatures = append(signatures, &signature{i, v})
-		}
+	// Read header
+	h, err := readVerifyHeader(bufr, options)
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		return nil, ctxErr
+	} else if err != nil {
+		return nil, err
 	}
+	signatures := scanSignatures(h)
 
 	tooManySignatures := false
 	if options != nil && options.MaxVerifications > 0 && len(signatures) > options.MaxVerifications {
@@ -134,17 +374,22 @@ func VerifyWithOptions(r io.Reader, options *VerifyOptions) ([]*Verification, er
 		signatures = signatures[:options.MaxVerifications]
 	}
 
+	var lookups *lookupCounter
+	if options != nil && options.MaxDNSLookups > 0 {
+		lookups = &lookupCounter{max: int32(options.MaxDNSLookups)}
+	}
+
 	var verifs []*Verification
 	if len(signatures) == 1 {
 		// If there is only one signature - just verify it.
-		v, err := verify(h, bufr, h[signatures[0].i], signatures[0].v, options)
+		v, err := verify(ctx, h, bufr, h[signatures[0].i], signatures[0].v, options, lookups)
 		if err != nil && !IsTempFail(err) && !IsPermFail(err) && !isFail(err) {
 			return nil, err
 		}
 		v.Err = err
 		verifs = []*Verification{v}
 	} else {
-		verifs, err = parallelVerify(bufr, h, signatures, options)
+		verifs, err = parallelVerify(ctx, bufr, h, signatures, options, lookups)
 		if err != nil {
 			return nil, err
 		}
@@ -156,7 +401,178 @@ func VerifyWithOptions(r io.Reader, options *VerifyOptions) ([]*Verification, er
 	return verifs, nil
 }
 
-func parallelVerify(r io.Reader, h header, signatures []*signature, options *VerifyOptions) ([]*Verification, error) {
+// VerifyOne performs the same task as VerifyWithOptions, but only verifies the
+// signature at the given zero-based index among the DKIM-Signature header
+// fields of the message. The other signatures are ignored.
+func VerifyOne(r io.Reader, index int, options *VerifyOptions) (*Verification, error) {
+	return VerifyOneWithContext(context.Background(), r, index, options)
+}
+
+// VerifyOneWithContext performs the same task as VerifyOne, but stops
+// verifying when ctx is cancelled, like VerifyWithContext.
+func VerifyOneWithContext(ctx context.Context, r io.Reader, index int, options *VerifyOptions) (*Verification, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ctx.Done() != nil {
+		r = &contextReader{ctx, r}
+	}
+
+	bufr, closer, err := newVerifyReader(r, options)
+	if err != nil {
+		return nil, err
+	}
+	if closer != nil {
+		defer closer.Close()
+	}
+
+	h, err := readVerifyHeader(bufr, options)
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		return nil, ctxErr
+	} else if err != nil {
+		return nil, err
+	}
+	signatures := scanSignatures(h)
+	if index < 0 || index >= len(signatures) {
+		return nil, fmt.Errorf("dkim: signature index %v out of range (message has %v signatures)", index, len(signatures))
+	}
+	sig := signatures[index]
+
+	var lookups *lookupCounter
+	if options != nil && options.MaxDNSLookups > 0 {
+		lookups = &lookupCounter{max: int32(options.MaxDNSLookups)}
+	}
+
+	v, err := verify(ctx, h, bufr, h[sig.i], sig.v, options, lookups)
+	if err != nil && !IsTempFail(err) && !IsPermFail(err) && !isFail(err) {
+		return nil, err
+	}
+	v.Err = err
+	return v, nil
+}
+
+// contextReader is an io.Reader which fails once its context is cancelled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(b []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(b)
+}
+
+// newVerifyReader wraps r in a buffered reader, transparently decompressing
+// the message if enabled in options. The returned io.Closer, if non-nil, must
+// be closed when done.
+func newVerifyReader(r io.Reader, options *VerifyOptions) (*bufio.Reader, io.Closer, error) {
+	bufr := bufio.NewReader(r)
+	if options != nil && options.AutoDecompress {
+		if magic, err := bufr.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+			gr, err := gzip.NewReader(bufr)
+			if err != nil {
+				return nil, nil, err
+			}
+			return bufio.NewReader(gr), gr, nil
+		}
+	}
+	return bufr, nil, nil
+}
+
+// readVerifyHeader reads the header of a message to verify.
+func readVerifyHeader(r *bufio.Reader, options *VerifyOptions) (header, error) {
+	maxSize := 0
+	if options != nil {
+		maxSize = options.MaxHeaderSize
+	}
+	return readHeaderLimit(r, false, maxSize)
+}
+
+// scanSignatures returns the DKIM-Signature header fields of h.
+func scanSignatures(h header) []*signature {
+	var signatures []*signature
+	for i, kv := range h {
+		k, v := parseHeaderField(kv)
+		if strings.EqualFold(k, headerFieldName) {
+			signatures = append(signatures, &signature{i, v})
+		}
+	}
+	return signatures
+}
+
+// VerifyAll performs the same task as VerifyWithOptions, but additionally
+// returns an error if any signature fails to verify. The error combines the
+// errors of all failed signatures. It implements Unwrap() []error, so it can be
+// inspected with errors.Is and errors.As on Go 1.20 and later. The individual
+// errors are always available in Verification.Err: the verifications are
+// returned even if some of them failed.
+func VerifyAll(r io.Reader, options *VerifyOptions) ([]*Verification, error) {
+	verifs, err := VerifyWithOptions(r, options)
+	if err != nil && verifs == nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, v := range verifs {
+		if v.Err != nil {
+			errs = append(errs, v.Err)
+		}
+	}
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return verifs, nil
+	}
+	return verifs, joinError(errs)
+}
+
+// joinError is an error wrapping multiple errors, like errors.Join. Before Go
+// 1.20, errors.Is and errors.As don't look into it.
+type joinError []error
+
+func (errs joinError) Error() string {
+	l := make([]string, len(errs))
+	for i, err := range errs {
+		l[i] = err.Error()
+	}
+	return strings.Join(l, "\n")
+}
+
+func (errs joinError) Unwrap() []error {
+	return errs
+}
+
+// VerifyMessage performs the same task as VerifyWithOptions, but operates on
+// a parsed message.
+//
+// A parsed message header doesn't retain the original order of header fields
+// nor their original whitespace, so the raw header is reconstructed on a
+// best-effort basis. Signatures using the simple header canonicalization are
+// likely to fail to verify, only the relaxed header canonicalization is
+// reliably supported. Verify should be preferred when the raw message is
+// available.
+func VerifyMessage(m *mail.Message, options *VerifyOptions) ([]*Verification, error) {
+	keys := make([]string, 0, len(m.Header))
+	for k := range m.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	for _, k := range keys {
+		for _, v := range m.Header[k] {
+			b.WriteString(k + ": " + v + crlf)
+		}
+	}
+	b.WriteString(crlf)
+
+	return VerifyWithOptions(io.MultiReader(&b, m.Body), options)
+}
+
+func parallelVerify(ctx context.Context, r io.Reader, h header, signatures []*signature, options *VerifyOptions, lookups *lookupCounter) ([]*Verification, error) {
 	pipeWriters := make([]*io.PipeWriter, len(signatures))
 	// We can't pass pipeWriter to io.MultiWriter directly,
 	// we need a slice of io.Writer, but we also need *io.PipeWriter
@@ -175,7 +591,7 @@ func parallelVerify(r io.Reader, h header, signatures []*signature, options *Ver
 		pipeWriters[i] = pw
 
 		go func() {
-			v, err := verify(h, pr, h[sig.i], sig.v, options)
+			v, err := verify(ctx, h, pr, h[sig.i], sig.v, options, lookups)
 
 			// Make sure we consume the whole reader, otherwise io.Copy on
 			// other side can block forever.
@@ -187,6 +603,10 @@ func parallelVerify(r io.Reader, h header, signatures []*signature, options *Ver
 	}
 
 	if _, err := io.Copy(io.MultiWriter(writers...), r); err != nil {
+		// Unblock the verifying goroutines
+		for _, wr := range pipeWriters {
+			wr.CloseWithError(err)
+		}
 		return nil, err
 	}
 	for _, wr := range pipeWriters {
@@ -209,8 +629,44 @@ func parallelVerify(r io.Reader, h header, signatures []*signature, options *Ver
 	return verifications, nil
 }
 
-func verify(h header, r io.Reader, sigField, sigValue string, options *VerifyOptions) (*Verification, error) {
-	verif := new(Verification)
+// newTXTLookup returns the TXT lookup function to use for public key queries.
+func newTXTLookup(ctx context.Context, options *VerifyOptions) txtLookupFunc {
+	lookupTXT := func(domain string) ([]string, error) {
+		return net.DefaultResolver.LookupTXT(ctx, domain)
+	}
+	if options == nil {
+		return lookupTXT
+	}
+	if options.LookupTXTContext != nil {
+		lookupTXT = func(domain string) ([]string, error) {
+			return options.LookupTXTContext(ctx, domain)
+		}
+	} else if options.LookupTXT != nil {
+		lookupTXT = options.LookupTXT
+	}
+	if options.LookupCNAME != nil {
+		return withCNAME(lookupTXT, options.LookupCNAME)
+	}
+	return lookupTXT
+}
+
+// lookupCounter limits the number of public key lookups performed for a
+// message. A nil *lookupCounter doesn't impose any limit.
+type lookupCounter struct {
+	max int32
+	n   int32
+}
+
+// take reserves a lookup. It returns false if the limit has been reached.
+func (c *lookupCounter) take() bool {
+	if c == nil {
+		return true
+	}
+	return atomic.AddInt32(&c.n, 1) <= c.max
+}
+
+func verify(ctx context.Context, h header, r io.Reader, sigField, sigValue string, options *VerifyOptions, lookups *lookupCounter) (*Verification, error) {
+	verif := &Verification{Signature: sigValue}
 
 	params, err := parseHeaderParams(sigValue)
 	if err != nil {
@@ -222,6 +678,8 @@ func verify(h header, r io.Reader, sigField, sigValue string, options *VerifyOpt
 	}
 
 	verif.Domain = stripWhitespace(params["d"])
+	verif.Selector = stripWhitespace(params["s"])
+	verif.Algorithm = stripWhitespace(params["a"])
 
 	for _, tag := range requiredTags {
 		if _, ok := params[tag]; !ok {
@@ -230,7 +688,11 @@ func verify(h header, r io.Reader, sigField, sigValue string, options *VerifyOpt
 	}
 
 	if i, ok := params["i"]; ok {
-		verif.Identifier = stripWhitespace(i)
+		identifier, err := decodeQuotedPrintable(i)
+		if err != nil {
+			return verif, permFailError("malformed identifier: " + strings.TrimPrefix(err.Error(), "dkim: "))
+		}
+		verif.Identifier = identifier
 		if !strings.HasSuffix(verif.Identifier, "@"+verif.Domain) && !strings.HasSuffix(verif.Identifier, "."+verif.Domain) {
 			return verif, permFailError("domain mismatch")
 		}
@@ -238,19 +700,35 @@ func verify(h header, r io.Reader, sigField, sigValue string, options *VerifyOpt
 		verif.Identifier = "@" + verif.Domain
 	}
 
+	if stripWhitespace(params["h"]) == "" {
+		return verif, permFailError("empty signed header list")
+	}
 	headerKeys := parseTagList(params["h"])
-	ok := false
 	for _, k := range headerKeys {
 		if strings.EqualFold(k, "from") {
-			ok = true
-			break
+			verif.From.Signed++
 		}
 	}
-	if !ok {
+	if verif.From.Signed == 0 {
 		return verif, permFailError("From field not signed")
 	}
 	verif.HeaderKeys = headerKeys
 
+	if options != nil {
+		for _, required := range options.RequireSignedHeaders {
+			if !containsFold(headerKeys, required) {
+				return verif, permFailError(fmt.Sprintf("required header field not signed: %v", required))
+			}
+		}
+	}
+
+	for _, kv := range h {
+		if k, _ := parseHeaderField(kv); strings.EqualFold(k, "from") {
+			verif.From.Present++
+		}
+	}
+	verif.From.Oversigned = verif.From.Signed > verif.From.Present
+
 	if timeStr, ok := params["t"]; ok {
 		t, err := parseTime(timeStr)
 		if err != nil {
@@ -264,7 +742,19 @@ func verify(h header, r io.Reader, sigField, sigValue string, options *VerifyOpt
 			return verif, permFailError("malformed expiration time: " + err.Error())
 		}
 		verif.Expiration = t
-		if now().After(t) {
+		if _, ok := params["t"]; ok {
+			// RFC 6376 section 3.5: x MUST be greater than t
+			if !t.After(verif.Time) {
+				return verif, permFailError("expiration time is not after signature time")
+			}
+			if options != nil && options.MaxValidityWindow > 0 && t.Sub(verif.Time) > options.MaxValidityWindow {
+				return verif, permFailError("signature validity window is too long")
+			}
+		}
+		// RFC 6376 section 3.5: signatures are invalid once the verification
+		// time is past the expiration time, so a signature expiring exactly
+		// now is still valid
+		if verifyNow(options).After(t) {
 			return verif, permFailError("signature has expired")
 		}
 	}
@@ -275,28 +765,42 @@ func verify(h header, r io.Reader, sigField, sigValue string, options *VerifyOpt
 	if methodsStr, ok := params["q"]; ok {
 		methods = parseTagList(methodsStr)
 	}
+	var customMethods map[QueryMethod]QueryFunc
+	if options != nil {
+		customMethods = options.QueryMethods
+	}
 	var res *queryResult
 	for _, method := range methods {
-		if query, ok := queryMethods[QueryMethod(method)]; ok {
-			if options != nil {
-				res, err = query(verif.Domain, stripWhitespace(params["s"]), options.LookupTXT)
-			} else {
-				res, err = query(verif.Domain, stripWhitespace(params["s"]), nil)
+		if query, ok := lookupQueryMethod(method, customMethods); ok {
+			if !lookups.take() {
+				return verif, tempFailError("too many DNS lookups")
+			}
+			if err := ctx.Err(); err != nil {
+				return verif, err
 			}
+			res, err = query(verif.Domain, verif.Selector, newTXTLookup(ctx, options))
 			break
 		}
 	}
 	if err != nil {
+		// Don't report a lookup aborted by the context as a key failure
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return verif, ctxErr
+		}
 		return verif, err
 	} else if res == nil {
 		return verif, permFailError("unsupported public key query method")
 	}
+	verif.PublicKey = res.publicKey()
 
 	// Parse algos
 	keyAlgo, hashAlgo, ok := strings.Cut(stripWhitespace(params["a"]), "-")
 	if !ok {
 		return verif, permFailError("malformed algorithm name")
 	}
+	// Some buggy signers append extra components, e.g. "rsa-sha256-": only
+	// consider the first two
+	hashAlgo, _, _ = strings.Cut(hashAlgo, "-")
 
 	// Check hash algo
 	if res.HashAlgos != nil {
@@ -337,7 +841,7 @@ func verify(h header, r io.Reader, sigField, sigValue string, options *VerifyOpt
 			}
 		}
 		if !ok {
-			return verif, permFailError("inappropriate service")
+			return verif, permFailError("inappropriate service: key is not usable for email")
 		}
 	}
 
@@ -350,10 +854,21 @@ func verify(h header, r io.Reader, sigField, sigValue string, options *VerifyOpt
 	}
 
 	// The body length "l" parameter is insecure, because it allows parts of
-	// the message body to not be signed. Reject messages which have it set.
-	if _, ok := params["l"]; ok {
-		// TODO: technically should be policyError
-		return verif, failError("message contains an insecure body length tag")
+	// the message body to not be signed. Reject messages which have it set,
+	// unless explicitly allowed.
+	bodyLength := int64(-1)
+	if lStr, ok := params["l"]; ok {
+		verif.PartialBody = true
+		if options == nil || !options.AllowBodyLength {
+			// TODO: technically should be policyError
+			return verif, failError("message contains an insecure body length tag")
+		}
+		l, err := strconv.ParseInt(stripWhitespace(lStr), 10, 64)
+		if err != nil || l < 0 {
+			return verif, permFailError("malformed body length")
+		}
+		bodyLength = l
+		verif.BodyLength = l
 	}
 
 	// Parse body hash and signature
@@ -365,25 +880,47 @@ func verify(h header, r io.Reader, sigField, sigValue string, options *VerifyOpt
 	if err != nil {
 		return verif, permFailError("malformed signature: " + err.Error())
 	}
+	if size := signatureSize(res.Verifier); size > 0 && len(sig) != size {
+		return verif, permFailError(fmt.Sprintf("malformed signature: invalid length for key: got %v bytes, want %v bytes", len(sig), size))
+	}
 
 	// Check body hash
 	hasher := hash.New()
-	wc := canonicalizers[bodyCan].CanonicalizeBody(hasher)
-	if _, err := io.Copy(wc, r); err != nil {
-		return verif, err
-	}
-	if err := wc.Close(); err != nil {
-		return verif, err
-	}
-	if subtle.ConstantTimeCompare(hasher.Sum(nil), bodyHashed) != 1 {
-		return verif, failError("body hash did not verify")
+	if options != nil && options.SkipBodyHash {
+		verif.HeaderOnly = true
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			return verif, err
+		}
+	} else {
+		var bodyWriter io.Writer = hasher
+		var lw *limitedWriter
+		if bodyLength >= 0 {
+			lw = &limitedWriter{W: hasher, N: bodyLength}
+			bodyWriter = lw
+		}
+		wc := canonicalizers[bodyCan].CanonicalizeBody(bodyWriter)
+		if _, err := io.Copy(wc, r); err != nil {
+			return verif, err
+		}
+		if err := wc.Close(); err != nil {
+			return verif, err
+		}
+		if lw != nil && lw.N > 0 {
+			return verif, permFailError("body length exceeds the canonicalized body length")
+		}
+		if subtle.ConstantTimeCompare(hasher.Sum(nil), bodyHashed) != 1 {
+			return verif, failError("body hash did not verify")
+		}
 	}
 
 	// Compute data hash
 	hasher.Reset()
 	picker := newHeaderPicker(h)
 	for _, key := range headerKeys {
-		kv := picker.Pick(key)
+		kv, index := picker.PickIndex(key)
+		if options != nil && options.HeaderInstances {
+			verif.HeaderInstances = append(verif.HeaderInstances, HeaderInstance{key, index})
+		}
 		if kv == "" {
 			// The field MAY contain names of header fields that do not exist
 			// when signed; nonexistent header fields do not contribute to the
@@ -396,6 +933,8 @@ func verify(h header, r io.Reader, sigField, sigValue string, options *VerifyOpt
 			return verif, err
 		}
 	}
+	verif.UnsignedHeaderKeys = unsignedHeaderKeys(h, headerKeys)
+
 	canSigField := removeSignature(sigField)
 	canSigField = canonicalizers[headerCan].CanonicalizeHeader(canSigField)
 	canSigField = strings.TrimRight(canSigField, "\r\n")
@@ -412,6 +951,50 @@ func verify(h header, r io.Reader, sigField, sigValue string, options *VerifyOpt
 	return verif, nil
 }
 
+func containsFold(l []string, s string) bool {
+	for _, v := range l {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// unsignedHeaderKeys returns the signed header field names which have more
+// instances in the header than listed in the signature.
+func unsignedHeaderKeys(h header, headerKeys []string) []string {
+	signed := make(map[string]int)
+	var keys []string
+	for _, k := range headerKeys {
+		k = strings.ToLower(k)
+		if signed[k] == 0 {
+			keys = append(keys, k)
+		}
+		signed[k]++
+	}
+
+	present := make(map[string]int)
+	for _, kv := range h {
+		k, _ := parseHeaderField(kv)
+		present[strings.ToLower(k)]++
+	}
+
+	var unsigned []string
+	for _, k := range keys {
+		if present[k] > signed[k] {
+			unsigned = append(unsigned, k)
+		}
+	}
+	return unsigned
+}
+
+func verifyNow(options *VerifyOptions) time.Time {
+	if options != nil && options.Now != nil {
+		return options.Now()
+	}
+	return now()
+}
+
 func parseTagList(s string) []string {
 	tags := strings.Split(s, ":")
 	for i, t := range tags {
@@ -442,20 +1025,38 @@ func parseTime(s string) (time.Time, error) {
 	return time.Unix(sec, 0), nil
 }
 
+// decodeBase64String decodes a base64 tag value. Some signers strip the
+// padding, so unpadded values are accepted as well.
 func decodeBase64String(s string) ([]byte, error) {
-	return base64.StdEncoding.DecodeString(stripWhitespace(s))
+	s = stripWhitespace(s)
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil && !strings.HasSuffix(s, "=") {
+		if b, rawErr := base64.RawStdEncoding.DecodeString(s); rawErr == nil {
+			return b, nil
+		}
+	}
+	return b, err
 }
 
+// stripWhitespace removes folding whitespace (SP, HTAB, CR and LF) from a
+// string. It operates on bytes, so that non-ASCII and invalid UTF-8 sequences
+// are left untouched.
 func stripWhitespace(s string) string {
-	return strings.Map(func(r rune) rune {
-		if unicode.IsSpace(r) {
-			return -1
+	var sb strings.Builder
+	sb.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; ch {
+		case ' ', '\t', '\r', '\n':
+		default:
+			sb.WriteByte(ch)
 		}
-		return r
-	}, s)
+	}
+	return sb.String()
 }
 
-var sigRegex = regexp.MustCompile(`(b\s*=)[^;]+`)
+// sigRegex matches the "b=" tag value. The tag name must be at the start of
+// a tag, possibly preceded by folding whitespace.
+var sigRegex = regexp.MustCompile(`((?:^|[:;])\s*b\s*=)[^;]+`)
 
 func removeSignature(s string) string {
 	return sigRegex.ReplaceAllString(s, "$1")
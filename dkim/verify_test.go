@@ -1,13 +1,25 @@
 package dkim
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"io"
 	"net"
+	"net/mail"
 	"reflect"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/emersion/go-msgauth/authres"
 )
 
 func newMailStringReader(s string) io.Reader {
@@ -38,6 +50,17 @@ func TestVerify_unsigned(t *testing.T) {
 	}
 }
 
+func TestNoSignatureResult(t *testing.T) {
+	res := NoSignatureResult()
+	if res.Value != authres.ResultNone {
+		t.Errorf("Expected result value to be %v, got %v", authres.ResultNone, res.Value)
+	}
+	got := strings.TrimSpace(authres.Format("example.org", []authres.Result{res}))
+	if want := "example.org; dkim=none"; got != want {
+		t.Errorf("Expected formatted result to be %q, got %q", want, got)
+	}
+}
+
 const verifiedMailString = `DKIM-Signature: v=1; a=rsa-sha256; s=brisbane; d=example.com;
       c=simple/simple; q=dns/txt; i=joe@football.example.com;
       h=Received : From : To : Subject : Date : Message-ID;
@@ -65,7 +88,19 @@ Joe.
 var testVerification = &Verification{
 	Domain:     "example.com",
 	Identifier: "joe@football.example.com",
+	Selector:   "brisbane",
+	Algorithm:  "rsa-sha256",
 	HeaderKeys: []string{"Received", "From", "To", "Subject", "Date", "Message-ID"},
+	From:       FromCoverage{Signed: 1, Present: 1},
+	Signature: "v=1; a=rsa-sha256; s=brisbane; d=example.com;\r\n" +
+		"      c=simple/simple; q=dns/txt; i=joe@football.example.com;\r\n" +
+		"      h=Received : From : To : Subject : Date : Message-ID;\r\n" +
+		"      bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		"      b=AuUoFEfDxTDkHlLXSZEpZj79LICEps6eda7W3deTVFOk4yAUoqOB\r\n" +
+		"      4nujc7YopdG5dWLSdNg6xNAZpOPr+kHxt1IrE+NahM6L/LbvaHut\r\n" +
+		"      KVdkLLkpVaVVQPzeRDI009SO2Il5Lu7rDNH6mZckBdrIx0orEtZV\r\n" +
+		"      4bmp/YzhwvcubU4=;",
+	PublicKey: mustParsePublicKey(dnsPublicKey),
 }
 
 func TestVerify(t *testing.T) {
@@ -140,8 +175,19 @@ Joe.
 var testRawRSAVerification = &Verification{
 	Domain:     "example.com",
 	Identifier: "joe@football.example.com",
+	Selector:   "newengland",
+	Algorithm:  "rsa-sha256",
 	HeaderKeys: []string{"Received", "From", "To", "Subject", "Date", "Message-ID"},
+	From:       FromCoverage{Signed: 1, Present: 1},
 	Time:       time.Unix(1615825284, 0),
+	Signature: "a=rsa-sha256; bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		" c=simple/simple; d=example.com;\r\n" +
+		" h=Received:From:To:Subject:Date:Message-ID; i=joe@football.example.com;\r\n" +
+		" s=newengland; t=1615825284; v=1;\r\n" +
+		" b=Xh4Ujb2wv5x54gXtulCiy4C0e+plRm6pZ4owF+kICpYzs/8WkTVIDBrzhJP0DAYCpnL62T0G\r\n" +
+		" k+0OH8pi/yqETVjKtKk+peMnNvKkut0GeWZMTze0bfq3/JUK3Ln3jTzzpXxrgVnvBxeY9EZIL4g\r\n" +
+		" s4wwFRRKz/1bksZGSjD8uuSU=",
+	PublicKey: mustParsePublicKey(dnsRawRSAPublicKey),
 }
 
 func TestVerify_rawRSA(t *testing.T) {
@@ -190,8 +236,19 @@ Joe.`
 var testEd25519Verification = &Verification{
 	Domain:     "football.example.com",
 	Identifier: "@football.example.com",
+	Selector:   "brisbane",
+	Algorithm:  "ed25519-sha256",
 	HeaderKeys: []string{"from", "to", "subject", "date", "message-id", "from", "subject", "date"},
+	From:       FromCoverage{Signed: 2, Present: 1, Oversigned: true},
 	Time:       time.Unix(1528637909, 0),
+	Signature: "v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+		" d=football.example.com; i=@football.example.com;\r\n" +
+		" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+		" subject : date : message-id : from : subject : date;\r\n" +
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+		" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==",
+	PublicKey: mustParsePublicKey(dnsEd25519PublicKey),
 }
 
 func TestVerify_ed25519(t *testing.T) {
@@ -210,6 +267,36 @@ func TestVerify_ed25519(t *testing.T) {
 	}
 }
 
+func TestVerifyOne(t *testing.T) {
+	r := newMailStringReader(verifiedEd25519MailString)
+
+	v, err := VerifyOne(r, 1, nil)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	}
+
+	want := *testEd25519Verification
+	want.Selector = "test"
+	want.Algorithm = "rsa-sha256"
+	want.PublicKey = mustParsePublicKey(dnsRFC8463PublicKey)
+	want.Signature = "v=1; a=rsa-sha256; c=relaxed/relaxed;\r\n" +
+		" d=football.example.com; i=@football.example.com;\r\n" +
+		" q=dns/txt; s=test; t=1528637909; h=from : to : subject :\r\n" +
+		" date : message-id : from : subject : date;\r\n" +
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		" b=F45dVWDfMbQDGHJFlXUNB2HKfbCeLRyhDXgFpEL8GwpsRe0IeIixNTe3\r\n" +
+		" DhCVlUrSjV4BwcVcOF6+FF3Zo9Rpo1tFOeS9mPYQTnGdaSGsgeefOsk2Jz\r\n" +
+		" dA+L10TeYt9BgDfQNZtKdN1WO//KgIqXP7OdEFE4LjFYNcUxZQ4FADY+8="
+	if !reflect.DeepEqual(&want, v) {
+		t.Errorf("Expected verification to be \n%+v\n but got \n%+v", &want, v)
+	}
+
+	r = newMailStringReader(verifiedEd25519MailString)
+	if _, err := VerifyOne(r, 2, nil); err == nil {
+		t.Errorf("Expected an error when verifying an out-of-range signature")
+	}
+}
+
 // errorReader reads from r and then returns an arbitrary error.
 type errorReader struct {
 	r   io.Reader
@@ -294,3 +381,1316 @@ func TestVerify_tooManySignatures(t *testing.T) {
 		t.Fatalf("Expected %v verifications, got %v", options.MaxVerifications, len(verifs))
 	}
 }
+
+func TestVerify_autoDecompress(t *testing.T) {
+	var b bytes.Buffer
+	gw := gzip.NewWriter(&b)
+	if _, err := io.Copy(gw, newMailStringReader(verifiedMailString)); err != nil {
+		t.Fatalf("Expected no error while compressing message, got: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("Expected no error while compressing message, got: %v", err)
+	}
+
+	options := VerifyOptions{AutoDecompress: true}
+	verifications, err := VerifyWithOptions(&b, &options)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+
+	v := verifications[0]
+	if !reflect.DeepEqual(testVerification, v) {
+		t.Errorf("Expected verification to be \n%+v\n but got \n%+v", testVerification, v)
+	}
+}
+
+func TestVerify_now(t *testing.T) {
+	r := strings.NewReader(mailString)
+	options := &SignOptions{
+		Domain:     "example.org",
+		Selector:   "brisbane",
+		Signer:     testPrivateKey,
+		Expiration: time.Unix(1000000, 0),
+		Now: func() time.Time {
+			return time.Unix(500000, 0)
+		},
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+	signed := b.String()
+
+	verifOptions := VerifyOptions{
+		Now: func() time.Time {
+			return time.Unix(2000000, 0)
+		},
+	}
+	verifications, err := VerifyWithOptions(strings.NewReader(signed), &verifOptions)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+	v := verifications[0]
+	if !IsPermFail(v.Err) {
+		t.Errorf("Expected an expired signature, got: %v", v.Err)
+	}
+	if !v.Time.Equal(time.Unix(500000, 0)) {
+		t.Errorf("Expected signature time to be %v, got %v", time.Unix(500000, 0), v.Time)
+	}
+
+	verifOptions.Now = func() time.Time {
+		return time.Unix(600000, 0)
+	}
+	verifications, err = VerifyWithOptions(strings.NewReader(signed), &verifOptions)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	} else if err := verifications[0].Err; err != nil {
+		t.Errorf("Expected no error when verifying signature, got: %v", err)
+	}
+}
+
+func TestVerify_expirationBoundary(t *testing.T) {
+	expiration := time.Unix(1000000, 0)
+	options := &SignOptions{
+		Domain:     "example.org",
+		Selector:   "brisbane",
+		Signer:     testPrivateKey,
+		Expiration: expiration,
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, strings.NewReader(mailString), options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+	signed := b.String()
+
+	tests := []struct {
+		now     time.Time
+		expired bool
+	}{
+		{expiration.Add(-time.Second), false},
+		{expiration, false},
+		{expiration.Add(time.Nanosecond), true},
+	}
+	for _, test := range tests {
+		verifOptions := VerifyOptions{
+			Now: func() time.Time {
+				return test.now
+			},
+		}
+		verifications, err := VerifyWithOptions(strings.NewReader(signed), &verifOptions)
+		if err != nil {
+			t.Fatalf("Expected no error while verifying signature, got: %v", err)
+		} else if len(verifications) != 1 {
+			t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+		}
+
+		err = verifications[0].Err
+		if test.expired && !IsPermFail(err) {
+			t.Errorf("Expected signature to be expired at %v, got: %v", test.now, err)
+		} else if !test.expired && err != nil {
+			t.Errorf("Expected signature to be valid at %v, got: %v", test.now, err)
+		}
+	}
+}
+
+func TestVerify_expirationBeforeTime(t *testing.T) {
+	for _, expiration := range []time.Time{time.Unix(1000, 0), time.Unix(2000, 0)} {
+		options := &SignOptions{
+			Domain:     "example.org",
+			Selector:   "brisbane",
+			Signer:     testPrivateKey,
+			Expiration: expiration,
+			Now: func() time.Time {
+				return time.Unix(2000, 0)
+			},
+		}
+
+		var b bytes.Buffer
+		if err := Sign(&b, strings.NewReader(mailString), options); err != nil {
+			t.Fatal("Expected no error while signing mail, got:", err)
+		}
+
+		verifOptions := VerifyOptions{
+			Now: func() time.Time {
+				return time.Unix(500, 0)
+			},
+		}
+		verifications, err := VerifyWithOptions(&b, &verifOptions)
+		if err != nil {
+			t.Fatalf("Expected no error while verifying signature, got: %v", err)
+		} else if len(verifications) != 1 {
+			t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+		}
+
+		err = verifications[0].Err
+		if !IsPermFail(err) {
+			t.Errorf("Expected a permanent failure for x=%v, got: %v", expiration.Unix(), err)
+		} else if !strings.Contains(err.Error(), "expiration time is not after signature time") {
+			t.Errorf("Expected an expiration time error for x=%v, got: %v", expiration.Unix(), err)
+		}
+	}
+}
+
+func TestVerify_maxValidityWindow(t *testing.T) {
+	signTime := time.Unix(424242, 0)
+	tests := []struct {
+		expiration time.Time
+		ok         bool
+	}{
+		{signTime.Add(24 * time.Hour), true},
+		{signTime.AddDate(3, 0, 0), false},
+		{time.Time{}, true}, // no expiration
+	}
+
+	for _, test := range tests {
+		options := &SignOptions{
+			Domain:     "example.org",
+			Selector:   "brisbane",
+			Signer:     testPrivateKey,
+			Expiration: test.expiration,
+		}
+
+		var b bytes.Buffer
+		if err := Sign(&b, strings.NewReader(mailString), options); err != nil {
+			t.Fatal("Expected no error while signing mail, got:", err)
+		}
+
+		verifOptions := VerifyOptions{
+			MaxValidityWindow: 7 * 24 * time.Hour,
+			Now: func() time.Time {
+				return signTime
+			},
+		}
+		verifications, err := VerifyWithOptions(&b, &verifOptions)
+		if err != nil {
+			t.Fatalf("Expected no error while verifying signature, got: %v", err)
+		} else if len(verifications) != 1 {
+			t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+		}
+
+		err = verifications[0].Err
+		if test.ok && err != nil {
+			t.Errorf("Expected no error when verifying signature expiring at %v, got: %v", test.expiration, err)
+		} else if !test.ok && !IsPermFail(err) {
+			t.Errorf("Expected a permanent failure for signature expiring at %v, got: %v", test.expiration, err)
+		}
+	}
+}
+
+func TestVerification_String(t *testing.T) {
+	v := &Verification{
+		Domain:    "example.com",
+		Selector:  "brisbane",
+		Algorithm: "rsa-sha256",
+	}
+	want := "pass for example.com (selector brisbane, algorithm rsa-sha256)"
+	if s := v.String(); s != want {
+		t.Errorf("Expected %q, got %q", want, s)
+	}
+
+	v.Err = failError("signature did not verify")
+	want = "fail for example.com (selector brisbane, algorithm rsa-sha256): dkim: signature did not verify"
+	if s := v.String(); s != want {
+		t.Errorf("Expected %q, got %q", want, s)
+	}
+}
+
+func TestVerification_MarshalJSON(t *testing.T) {
+	v := &Verification{
+		Domain:     "example.com",
+		Identifier: "joe@football.example.com",
+		Selector:   "brisbane",
+		Algorithm:  "rsa-sha256",
+		HeaderKeys: []string{"From", "To"},
+		Time:       time.Unix(1615825284, 0).UTC(),
+		Err:        failError("body hash did not verify"),
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Expected no error while marshaling verification, got: %v", err)
+	}
+
+	want := `{"domain":"example.com","identifier":"joe@football.example.com",` +
+		`"selector":"brisbane","algorithm":"rsa-sha256",` +
+		`"header_keys":["From","To"],"time":"2021-03-15T16:21:24Z",` +
+		`"result":"fail","error":"dkim: body hash did not verify"}`
+	if string(b) != want {
+		t.Errorf("Expected JSON to be \n%v\n but got \n%v", want, string(b))
+	}
+
+	v = &Verification{
+		Domain:      "example.com",
+		Selector:    "brisbane",
+		Algorithm:   "ed25519-sha256",
+		PartialBody: true,
+		BodyLength:  42,
+		Signature:   "v=1; a=ed25519-sha256; d=example.com; s=brisbane; l=42; b=dGVzdA==",
+	}
+
+	b, err = json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Expected no error while marshaling verification, got: %v", err)
+	}
+
+	want = `{"domain":"example.com","identifier":"","selector":"brisbane",` +
+		`"algorithm":"ed25519-sha256","header_keys":null,"body_length":42,` +
+		`"signature":"v=1; a=ed25519-sha256; d=example.com; s=brisbane; l=42; b=dGVzdA==",` +
+		`"result":"pass"}`
+	if string(b) != want {
+		t.Errorf("Expected JSON to be \n%v\n but got \n%v", want, string(b))
+	}
+}
+
+func TestVerification_AuthResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		verif    Verification
+		identity string
+		want     authres.DKIMResult
+	}{
+		{
+			name:  "pass",
+			verif: Verification{Domain: "example.org", Identifier: "@example.org", Selector: "brisbane"},
+			want: authres.DKIMResult{
+				Value:      authres.ResultPass,
+				Domain:     "example.org",
+				Identifier: "@example.org",
+				Selector:   "brisbane",
+			},
+		},
+		{
+			name: "fail",
+			verif: Verification{
+				Domain:     "example.org",
+				Identifier: "@example.org",
+				Err:        failError("signature did not verify"),
+			},
+			want: authres.DKIMResult{
+				Value:      authres.ResultFail,
+				Reason:     "signature did not verify",
+				Domain:     "example.org",
+				Identifier: "@example.org",
+			},
+		},
+		{
+			name: "permerror",
+			verif: Verification{
+				Domain: "example.org",
+				Err:    permFailError("no key for signature"),
+			},
+			want: authres.DKIMResult{
+				Value:  authres.ResultPermError,
+				Reason: "no key for signature",
+				Domain: "example.org",
+			},
+		},
+		{
+			name: "temperror",
+			verif: Verification{
+				Domain:     "example.org",
+				Identifier: "@example.org",
+				Err:        tempFailError("key unavailable"),
+			},
+			identity: "joe@example.org",
+			want: authres.DKIMResult{
+				Value:      authres.ResultTempError,
+				Reason:     "key unavailable",
+				Domain:     "example.org",
+				Identifier: "joe@example.org",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := test.verif.AuthResult(test.identity)
+			if !reflect.DeepEqual(*res, test.want) {
+				t.Errorf("Expected result to be \n%+v\n but got \n%+v", test.want, *res)
+			}
+		})
+	}
+}
+
+func TestVerify_headerInstances(t *testing.T) {
+	r := strings.NewReader("Received: from a.example.org\r\n" +
+		"Received: from b.example.org\r\n" +
+		mailString)
+	options := &SignOptions{
+		Domain:     "example.org",
+		Selector:   "brisbane",
+		Signer:     testPrivateKey,
+		HeaderKeys: []string{"Received", "Received", "Received", "From"},
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	verifOptions := VerifyOptions{HeaderInstances: true}
+	verifications, err := VerifyWithOptions(&b, &verifOptions)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+
+	v := verifications[0]
+	if v.Err != nil {
+		t.Errorf("Expected no error when verifying signature, got: %v", v.Err)
+	}
+	want := []HeaderInstance{
+		{"Received", 2},
+		{"Received", 1},
+		{"Received", -1},
+		{"From", 3},
+	}
+	if !reflect.DeepEqual(v.HeaderInstances, want) {
+		t.Errorf("Expected header instances to be \n%+v\n but got \n%+v", want, v.HeaderInstances)
+	}
+}
+
+const emptyHeaderKeysMailString = `DKIM-Signature: v=1; a=rsa-sha256; s=brisbane; d=example.com;
+      c=simple/simple; q=dns/txt; i=joe@football.example.com;
+      h= ;
+      bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;
+      b=AuUoFEfDxTDkHlLXSZEpZj79LICEps6eda7W3deTVFOk4yAUoqOB
+      4nujc7YopdG5dWLSdNg6xNAZpOPr+kHxt1IrE+NahM6L/LbvaHut
+      KVdkLLkpVaVVQPzeRDI009SO2Il5Lu7rDNH6mZckBdrIx0orEtZV
+      4bmp/YzhwvcubU4=;
+From: Joe SixPack <joe@football.example.com>
+
+Hi.
+`
+
+func TestVerify_emptyHeaderKeys(t *testing.T) {
+	r := newMailStringReader(emptyHeaderKeysMailString)
+
+	verifications, err := Verify(r)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+
+	err = verifications[0].Err
+	if !IsPermFail(err) {
+		t.Fatalf("Expected a permanent failure, got: %v", err)
+	} else if !strings.Contains(err.Error(), "empty signed header list") {
+		t.Errorf("Expected an empty signed header list error, got: %v", err)
+	}
+}
+
+func TestDecodeBase64String(t *testing.T) {
+	for _, s := range []string{"aGV5IQ==", "aGV5IQ", " aGV5\r\n IQ= = "} {
+		b, err := decodeBase64String(s)
+		if err != nil {
+			t.Errorf("Expected no error while decoding %q, got: %v", s, err)
+		} else if string(b) != "hey!" {
+			t.Errorf("Expected %q to decode to %q, got %q", s, "hey!", b)
+		}
+	}
+
+	if _, err := decodeBase64String("aGV5I"); err == nil {
+		t.Errorf("Expected an error while decoding truncated base64")
+	}
+}
+
+func TestVerify_unpaddedSignature(t *testing.T) {
+	r := strings.NewReader(mailString)
+	options := &SignOptions{
+		Domain:   "football.example.com",
+		Selector: "brisbane",
+		Signer:   testEd25519PrivateKey,
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	// Ed25519 signatures are 64 bytes long, so they always end with "=="
+	signed := strings.Replace(b.String(), "==\r\n", "\r\n", 1)
+	if signed == b.String() {
+		t.Fatalf("Expected signature to be padded")
+	}
+	verifications, err := Verify(strings.NewReader(signed))
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+	if err := verifications[0].Err; err != nil {
+		t.Errorf("Expected no error when verifying signature, got: %v", err)
+	}
+}
+
+func TestVerify_unsignedHeaderKeys(t *testing.T) {
+	r := strings.NewReader(mailString)
+	options := &SignOptions{
+		Domain:     "example.org",
+		Selector:   "brisbane",
+		Signer:     testPrivateKey,
+		HeaderKeys: []string{"From", "To", "Subject"},
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	// Prepend an extra Subject: it's not picked since header fields are
+	// picked from the bottom
+	signed := "Subject: Free money\r\n" + b.String()
+	verifications, err := Verify(strings.NewReader(signed))
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+
+	v := verifications[0]
+	if v.Err != nil {
+		t.Errorf("Expected no error when verifying signature, got: %v", v.Err)
+	}
+	if want := []string{"subject"}; !reflect.DeepEqual(v.UnsignedHeaderKeys, want) {
+		t.Errorf("Expected unsigned header keys to be %v, got %v", want, v.UnsignedHeaderKeys)
+	}
+}
+
+func TestVerifyMessage(t *testing.T) {
+	r := strings.NewReader(mailString)
+	options := &SignOptions{
+		Domain:                 "example.org",
+		Selector:               "brisbane",
+		Signer:                 testPrivateKey,
+		HeaderCanonicalization: CanonicalizationRelaxed,
+		BodyCanonicalization:   CanonicalizationRelaxed,
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	m, err := mail.ReadMessage(&b)
+	if err != nil {
+		t.Fatalf("Expected no error while parsing message, got: %v", err)
+	}
+
+	verifications, err := VerifyMessage(m, nil)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+	if err := verifications[0].Err; err != nil {
+		t.Errorf("Expected no error when verifying signature, got: %v", err)
+	}
+}
+
+func TestVerify_oversignedFrom(t *testing.T) {
+	r := strings.NewReader(mailString)
+	options := &SignOptions{
+		Domain:     "example.org",
+		Selector:   "brisbane",
+		Signer:     testPrivateKey,
+		HeaderKeys: []string{"From", "From", "To", "Subject"},
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	verifications, err := Verify(&b)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+
+	v := verifications[0]
+	if v.Err != nil {
+		t.Errorf("Expected no error when verifying signature, got: %v", v.Err)
+	}
+	want := FromCoverage{Signed: 2, Present: 1, Oversigned: true}
+	if v.From != want {
+		t.Errorf("Expected From coverage to be %+v, got %+v", want, v.From)
+	}
+}
+
+func TestVerify_requireSignedHeaders(t *testing.T) {
+	r := strings.NewReader(mailString)
+	options := &SignOptions{
+		Domain:     "example.org",
+		Selector:   "brisbane",
+		Signer:     testPrivateKey,
+		HeaderKeys: []string{"From", "To", "Date"},
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	verifOptions := VerifyOptions{RequireSignedHeaders: []string{"date", "Subject"}}
+	verifications, err := VerifyWithOptions(&b, &verifOptions)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+
+	err = verifications[0].Err
+	if !IsPermFail(err) {
+		t.Fatalf("Expected a permanent failure, got: %v", err)
+	} else if !strings.Contains(err.Error(), "Subject") {
+		t.Errorf("Expected error to name the missing header field, got: %v", err)
+	}
+}
+
+func TestVerify_skipBodyHash(t *testing.T) {
+	r := strings.NewReader(mailString)
+	options := &SignOptions{
+		Domain:   "example.org",
+		Selector: "brisbane",
+		Signer:   testPrivateKey,
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+	modified := b.String() + "Modified by a mailing list.\r\n"
+
+	verifications, err := Verify(strings.NewReader(modified))
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	} else if verifications[0].Err == nil {
+		t.Fatalf("Expected an error while verifying modified message")
+	}
+
+	verifOptions := VerifyOptions{SkipBodyHash: true}
+	verifications, err = VerifyWithOptions(strings.NewReader(modified), &verifOptions)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+	v := verifications[0]
+	if v.Err != nil {
+		t.Errorf("Expected no error while verifying header-only signature, got: %v", v.Err)
+	}
+	if !v.HeaderOnly {
+		t.Errorf("Expected verification to be marked as header-only")
+	}
+}
+
+func TestVerifyAll(t *testing.T) {
+	// Two signatures which fail for different reasons
+	var b bytes.Buffer
+	options := &SignOptions{
+		Domain:     "example.org",
+		Selector:   "brisbane",
+		Signer:     testPrivateKey,
+		BodyLength: 5,
+	}
+	if err := Sign(&b, strings.NewReader(mailString), options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+	options = &SignOptions{
+		Domain:   "example.com",
+		Selector: "newengland", // a different key
+		Signer:   testPrivateKey,
+	}
+	var b2 bytes.Buffer
+	if err := Sign(&b2, &b, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	verifications, err := VerifyAll(&b2, nil)
+	if err == nil {
+		t.Fatal("Expected an error while verifying signatures")
+	} else if len(verifications) != 2 {
+		t.Fatalf("Expected exactly two verifications, got %v", len(verifications))
+	}
+	for _, v := range verifications {
+		if v.Err == nil {
+			t.Errorf("Expected signature for %v to fail", v.Domain)
+		} else if !strings.Contains(err.Error(), v.Err.Error()) {
+			t.Errorf("Expected joined error %q to contain %q", err, v.Err)
+		}
+	}
+	if !strings.Contains(err.Error(), "insecure body length tag") || !strings.Contains(err.Error(), "signature did not verify") {
+		t.Errorf("Expected joined error to contain both failure reasons, got: %v", err)
+	}
+
+	// errors.As only supports Unwrap() []error on Go 1.20 and later
+	wrapsFailErr := false
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, err := range joined.Unwrap() {
+			if _, ok := err.(failError); ok {
+				wrapsFailErr = true
+			}
+		}
+	}
+	if !wrapsFailErr {
+		t.Errorf("Expected joined error to wrap a failError")
+	}
+
+	// Valid signatures don't produce an error
+	b.Reset()
+	if err := Sign(&b, strings.NewReader(mailString), &SignOptions{
+		Domain:   "example.org",
+		Selector: "brisbane",
+		Signer:   testPrivateKey,
+	}); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+	if _, err := VerifyAll(&b, nil); err != nil {
+		t.Errorf("Expected no error while verifying signature, got: %v", err)
+	}
+}
+
+// signTabFolded signs mailString with a DKIM-Signature header field folded
+// with tabs, including inside the "b=" tag value.
+func signTabFolded(t *testing.T, can Canonicalization) string {
+	hasher := sha256.New()
+	wc := canonicalizers[can].CanonicalizeBody(hasher)
+	if _, err := io.WriteString(wc, mailBodyString); err != nil {
+		t.Fatal(err)
+	}
+	if err := wc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	bh := base64.StdEncoding.EncodeToString(hasher.Sum(nil))
+
+	sigPrefix := "DKIM-Signature: v=1; a=rsa-sha256; c=" + string(can) + "/" + string(can) + ";\r\n" +
+		"\td=example.org; s=brisbane;\r\n" +
+		"\th=From:To:Subject; bh=" + bh + ";\r\n" +
+		"\tb="
+
+	hasher.Reset()
+	h, err := readHeader(bufio.NewReader(strings.NewReader(mailHeaderString + "\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	picker := newHeaderPicker(h)
+	for _, k := range []string{"From", "To", "Subject"} {
+		io.WriteString(hasher, canonicalizers[can].CanonicalizeHeader(picker.Pick(k)))
+	}
+	io.WriteString(hasher, strings.TrimRight(canonicalizers[can].CanonicalizeHeader(sigPrefix), "\r\n"))
+
+	sig, err := testPrivateKey.Sign(rand.Reader, hasher.Sum(nil), crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := base64.StdEncoding.EncodeToString(sig)
+	return sigPrefix + b[:40] + "\r\n\t" + b[40:] + "\r\n" + mailString
+}
+
+func TestVerify_tabFolded(t *testing.T) {
+	for _, can := range []Canonicalization{CanonicalizationSimple, CanonicalizationRelaxed} {
+		t.Run(string(can), func(t *testing.T) {
+			verifications, err := Verify(strings.NewReader(signTabFolded(t, can)))
+			if err != nil {
+				t.Fatalf("Expected no error while verifying signature, got: %v", err)
+			} else if len(verifications) != 1 {
+				t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+			} else if err := verifications[0].Err; err != nil {
+				t.Errorf("Expected no error while verifying signature, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestRemoveSignature(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{
+			"DKIM-Signature: v=1; b=abc\r\n\tdef; bh=xyz\r\n",
+			"DKIM-Signature: v=1; b=; bh=xyz\r\n",
+		},
+		{
+			"DKIM-Signature: v=1;\r\n\tb\t=\tabc\r\n\tdef\r\n",
+			"DKIM-Signature: v=1;\r\n\tb\t=",
+		},
+		{
+			"DKIM-Signature: b=abc; v=1\r\n",
+			"DKIM-Signature: b=; v=1\r\n",
+		},
+		{
+			// "b" inside another tag name must be left alone
+			"DKIM-Signature: v=1; zb=abc; b=def\r\n",
+			"DKIM-Signature: v=1; zb=abc; b=",
+		},
+	}
+	for _, test := range tests {
+		if got := removeSignature(test.in); got != test.want {
+			t.Errorf("removeSignature(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestVerify_unsupportedAlgorithm(t *testing.T) {
+	r := strings.NewReader(mailString)
+	options := &SignOptions{
+		Domain:   "example.org",
+		Selector: "brisbane",
+		Signer:   testPrivateKey,
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	// Prepend a copy of the signature using an unsupported hash algorithm
+	signed := b.String()
+	sig := signed[:strings.Index(signed, "\r\n"+mailHeaderString)+2]
+	md5Sig := strings.Replace(sig, "a=rsa-sha256", "a=rsa-md5", 1)
+	md5Sig = strings.Replace(md5Sig, "d=example.org", "d=example.com", 1)
+	if md5Sig == sig {
+		t.Fatal("Failed to rewrite signature algorithm")
+	}
+
+	verifications, err := Verify(strings.NewReader(md5Sig + signed))
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signatures, got: %v", err)
+	} else if len(verifications) != 2 {
+		t.Fatalf("Expected exactly two verifications, got %v", len(verifications))
+	}
+
+	for _, v := range verifications {
+		switch v.Domain {
+		case "example.com":
+			if !IsPermFail(v.Err) || !strings.Contains(v.Err.Error(), "unsupported hash algorithm") {
+				t.Errorf("Expected an unsupported hash algorithm failure for the rsa-md5 signature, got: %v", v.Err)
+			}
+		case "example.org":
+			if v.Err != nil {
+				t.Errorf("Expected no error for the rsa-sha256 signature, got: %v", v.Err)
+			}
+		default:
+			t.Errorf("Unexpected verification for %v", v.Domain)
+		}
+	}
+}
+
+func TestVerify_algorithmComponents(t *testing.T) {
+	tests := []struct {
+		algo string
+		ok   bool
+	}{
+		{"rsa-sha256-extra", true},
+		{"rsa-sha256-", true},
+		{"rsa", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.algo, func(t *testing.T) {
+			cfg, err := newSignConfig(&SignOptions{
+				Domain:   "example.org",
+				Selector: "brisbane",
+				Signer:   testPrivateKey,
+			})
+			if err != nil {
+				t.Fatal("Expected no error while creating signing config, got:", err)
+			}
+			// Sign with SHA-256, but advertise test.algo in the signature
+			cfg.keyAlgo, cfg.hashAlgo, _ = strings.Cut(test.algo, "-")
+
+			h, err := readHeader(bufio.NewReader(strings.NewReader(mailString)))
+			if err != nil {
+				t.Fatal("Expected no error while reading header, got:", err)
+			}
+			bodyHashed, err := cfg.hashBody(strings.NewReader(mailBodyString))
+			if err != nil {
+				t.Fatal("Expected no error while hashing body, got:", err)
+			}
+			params, err := cfg.sign(h, bodyHashed)
+			if err != nil {
+				t.Fatal("Expected no error while signing, got:", err)
+			}
+			params["a"] = test.algo
+
+			r := strings.NewReader(formatSignature(params) + mailString)
+			verifications, err := Verify(r)
+			if err != nil {
+				t.Fatalf("Expected no error while verifying signature, got: %v", err)
+			} else if len(verifications) != 1 {
+				t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+			}
+
+			err = verifications[0].Err
+			if test.ok && err != nil {
+				t.Errorf("Expected no error when verifying signature, got: %v", err)
+			} else if !test.ok && !IsPermFail(err) {
+				t.Errorf("Expected a permanent failure, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestVerify_truncatedSignature(t *testing.T) {
+	tests := []struct {
+		name   string
+		domain string
+		signer crypto.Signer
+		want   string
+	}{
+		{"rsa", "example.org", testPrivateKey, "got 122 bytes, want 128 bytes"},
+		{"ed25519", "football.example.com", testEd25519PrivateKey, "got 58 bytes, want 64 bytes"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := NewSigner(&SignOptions{
+				Domain:   test.domain,
+				Selector: "brisbane",
+				Signer:   test.signer,
+			})
+			if err != nil {
+				t.Fatal("Expected no error while creating signer, got:", err)
+			}
+			if _, err := io.WriteString(s, mailString); err != nil {
+				t.Fatal("Expected no error while writing to signer, got:", err)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal("Expected no error while signing mail, got:", err)
+			}
+
+			_, v := parseHeaderField(s.Signature())
+			params, err := parseHeaderParams(v)
+			if err != nil {
+				t.Fatal("Expected no error while parsing signature, got:", err)
+			}
+			sig, err := decodeBase64String(params["b"])
+			if err != nil {
+				t.Fatal("Expected no error while decoding signature, got:", err)
+			}
+			params["b"] = base64.StdEncoding.EncodeToString(sig[:len(sig)-6])
+
+			r := strings.NewReader(formatSignature(params) + mailString)
+			verifications, err := Verify(r)
+			if err != nil {
+				t.Fatalf("Expected no error while verifying signature, got: %v", err)
+			} else if len(verifications) != 1 {
+				t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+			}
+
+			err = verifications[0].Err
+			if !IsPermFail(err) {
+				t.Errorf("Expected a permanent failure, got: %v", err)
+			} else if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("Expected a signature length error, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestVerify_bodyLengthTooLarge(t *testing.T) {
+	_, canonBody, err := CanonicalizeMessage(strings.NewReader(mailString), nil, CanonicalizationSimple, CanonicalizationSimple)
+	if err != nil {
+		t.Fatalf("Expected no error while canonicalizing message, got: %v", err)
+	}
+
+	options := &SignOptions{
+		Domain:     "example.org",
+		Selector:   "brisbane",
+		Signer:     testPrivateKey,
+		BodyLength: int64(len(canonBody)),
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, strings.NewReader(mailString), options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	// Remove the last body line, so that the body is shorter than l=
+	r := strings.NewReader(strings.TrimSuffix(b.String(), "Joe."))
+	verifications, err := VerifyWithOptions(r, &VerifyOptions{AllowBodyLength: true})
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+
+	v := verifications[0]
+	if !IsPermFail(v.Err) {
+		t.Errorf("Expected a permanent failure, got: %v", v.Err)
+	}
+	if v.BodyLength != options.BodyLength {
+		t.Errorf("Expected body length to be %v but got %v", options.BodyLength, v.BodyLength)
+	}
+}
+
+func TestVerify_selectorOnKeyLookupError(t *testing.T) {
+	options := &SignOptions{
+		Domain:   "example.org",
+		Selector: "rotated",
+		Signer:   testPrivateKey,
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, strings.NewReader(mailString), options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	query := func(domain, selector string) (*PublicKey, error) {
+		name := selector + "._domainkey." + domain
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	verifications, err := VerifyWithOptions(&b, &VerifyOptions{
+		QueryMethods: map[QueryMethod]QueryFunc{QueryMethodDNSTXT: query},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+
+	v := verifications[0]
+	if !IsPermFail(v.Err) {
+		t.Errorf("Expected a permanent failure, got: %v", v.Err)
+	}
+	if v.Selector != options.Selector {
+		t.Errorf("Expected selector to be %q but got %q", options.Selector, v.Selector)
+	}
+	if v.PublicKey != nil {
+		t.Errorf("Expected no public key, got %+v", v.PublicKey)
+	}
+}
+
+func TestVerify_publicKey(t *testing.T) {
+	options := &SignOptions{
+		Domain:   "example.org",
+		Selector: "testing",
+		Signer:   testPrivateKey,
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, strings.NewReader(mailString), options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	verifications, err := Verify(&b)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+
+	v := verifications[0]
+	if v.Err != nil {
+		t.Fatalf("Expected no error when verifying signature, got: %v", v.Err)
+	}
+	pub := v.PublicKey
+	if pub == nil {
+		t.Fatal("Expected a public key")
+	}
+	if pub.KeyAlgo != "rsa" {
+		t.Errorf("Expected key algorithm to be rsa, got %v", pub.KeyAlgo)
+	}
+	if !reflect.DeepEqual(pub.Flags, []string{"y"}) {
+		t.Errorf("Expected flags to be [y], got %v", pub.Flags)
+	}
+	if !reflect.DeepEqual(pub.Services, []string{"email"}) {
+		t.Errorf("Expected services to be [email], got %v", pub.Services)
+	}
+}
+
+func TestVerifyWithContext(t *testing.T) {
+	defer setQueryMethod(QueryMethodDNSTXT, setQueryMethod(QueryMethodDNSTXT, queryDNSTXT))
+
+	var b bytes.Buffer
+	err := SignMultiple(&b, strings.NewReader(mailString), []*SignOptions{
+		{Domain: "example.org", Selector: "brisbane", Signer: testPrivateKey},
+		{Domain: "football.example.com", Selector: "brisbane", Signer: testEd25519PrivateKey},
+	})
+	if err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+	signed := b.String()
+
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, true)
+	options := &VerifyOptions{
+		LookupTXTContext: func(ctx context.Context, domain string) ([]string, error) {
+			if ctx.Value(ctxKey{}) == nil {
+				t.Errorf("Expected the context to be passed to LookupTXTContext")
+			}
+			switch domain {
+			case "brisbane._domainkey.example.org":
+				return []string{dnsPublicKey}, nil
+			case "brisbane._domainkey.football.example.com":
+				return []string{dnsEd25519PublicKey}, nil
+			}
+			return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+		},
+	}
+	verifications, err := VerifyWithContext(ctx, strings.NewReader(signed), options)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 2 {
+		t.Fatalf("Expected exactly two verifications, got %v", len(verifications))
+	}
+	for i, v := range verifications {
+		if v.Err != nil {
+			t.Errorf("Expected no error when verifying signature #%v, got: %v", i, v.Err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := VerifyWithContext(ctx, strings.NewReader(signed), options); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a context error when verifying with a cancelled context, got: %v", err)
+	}
+
+	// Cancel the context while looking up keys
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	options.LookupTXTContext = func(ctx context.Context, domain string) ([]string, error) {
+		cancel()
+		return nil, &net.DNSError{Err: "operation was canceled", Name: domain, IsTemporary: true}
+	}
+	verifications, err = VerifyWithContext(ctx, strings.NewReader(signed), options)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a context error when cancelling during verification, got: %v", err)
+	} else if verifications != nil {
+		t.Errorf("Expected no verification, got %v", verifications)
+	}
+}
+
+func TestVerifyOneWithContext(t *testing.T) {
+	defer setQueryMethod(QueryMethodDNSTXT, setQueryMethod(QueryMethodDNSTXT, queryDNSTXT))
+
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, true)
+	options := &VerifyOptions{
+		LookupTXTContext: func(ctx context.Context, domain string) ([]string, error) {
+			if ctx.Value(ctxKey{}) == nil {
+				t.Errorf("Expected the context to be passed to LookupTXTContext")
+			}
+			if domain != "test._domainkey.football.example.com" {
+				return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+			}
+			return []string{dnsRFC8463PublicKey}, nil
+		},
+	}
+
+	v, err := VerifyOneWithContext(ctx, newMailStringReader(verifiedEd25519MailString), 1, options)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if v.Err != nil {
+		t.Errorf("Expected no error when verifying signature, got: %v", v.Err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := VerifyOneWithContext(ctx, newMailStringReader(verifiedEd25519MailString), 1, options); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a context error when verifying with a cancelled context, got: %v", err)
+	}
+}
+
+func TestVerify_longHeaderLine(t *testing.T) {
+	received := "Received: " + strings.Repeat("from relay.example.org by mx.example.com; ", 2000) + "\r\n"
+	mail := received + mailString
+
+	h, err := readHeader(bufio.NewReader(strings.NewReader(mail)))
+	if err != nil {
+		t.Fatalf("Expected no error while reading header, got: %v", err)
+	} else if h[0] != received {
+		t.Fatalf("Expected the long header line to be read without truncation, got %v bytes", len(h[0]))
+	}
+	if _, err := readHeaderLimit(bufio.NewReader(strings.NewReader(mail)), false, len(received)/2); err != ErrHeaderTooLarge {
+		t.Errorf("Expected ErrHeaderTooLarge while reading a header line exceeding the limit, got: %v", err)
+	}
+
+	for _, can := range []Canonicalization{CanonicalizationSimple, CanonicalizationRelaxed} {
+		t.Run(string(can), func(t *testing.T) {
+			options := &SignOptions{
+				Domain:                 "example.org",
+				Selector:               "brisbane",
+				Signer:                 testPrivateKey,
+				HeaderCanonicalization: can,
+				BodyCanonicalization:   can,
+			}
+
+			var b bytes.Buffer
+			if err := Sign(&b, strings.NewReader(mail), options); err != nil {
+				t.Fatal("Expected no error while signing mail, got:", err)
+			}
+			signed := b.String()
+			headerSize := strings.Index(signed, "\r\n\r\n") + 4
+
+			verifications, err := VerifyWithOptions(strings.NewReader(signed), &VerifyOptions{MaxHeaderSize: headerSize})
+			if err != nil {
+				t.Fatalf("Expected no error while verifying signature, got: %v", err)
+			} else if len(verifications) != 1 {
+				t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+			} else if err := verifications[0].Err; err != nil {
+				t.Errorf("Expected no error when verifying signature, got: %v", err)
+			}
+
+			_, err = VerifyWithOptions(strings.NewReader(signed), &VerifyOptions{MaxHeaderSize: headerSize - 1})
+			if err != ErrHeaderTooLarge {
+				t.Errorf("Expected ErrHeaderTooLarge, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestVerify_lookupTXTContextPreferred(t *testing.T) {
+	defer setQueryMethod(QueryMethodDNSTXT, setQueryMethod(QueryMethodDNSTXT, queryDNSTXT))
+
+	options := &SignOptions{
+		Domain:   "example.org",
+		Selector: "brisbane",
+		Signer:   testPrivateKey,
+	}
+	var b bytes.Buffer
+	if err := Sign(&b, strings.NewReader(mailString), options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	var queried []string
+	verifications, err := VerifyWithOptions(&b, &VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			t.Errorf("Expected LookupTXT not to be called when LookupTXTContext is set")
+			return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+		},
+		LookupTXTContext: func(ctx context.Context, domain string) ([]string, error) {
+			queried = append(queried, domain)
+			return []string{dnsPublicKey}, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	} else if err := verifications[0].Err; err != nil {
+		t.Errorf("Expected no error when verifying signature, got: %v", err)
+	}
+	if want := []string{"brisbane._domainkey.example.org"}; !reflect.DeepEqual(queried, want) {
+		t.Errorf("Expected queried names to be %v, got %v", want, queried)
+	}
+}
+
+func TestVerify_headerNameWhitespace(t *testing.T) {
+	options := &SignOptions{
+		Domain:                 "example.org",
+		Selector:               "brisbane",
+		Signer:                 testPrivateKey,
+		HeaderCanonicalization: CanonicalizationRelaxed,
+		HeaderKeys:             []string{"From", "To", "Subject"},
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, strings.NewReader(mailString), options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	// A field whose name contains whitespace isn't a Subject field: it must
+	// not be picked instead of the signed one
+	signed := strings.Replace(b.String(), "Subject: Is dinner ready?\r\n", "Subject: Is dinner ready?\r\nSub ject: Free money\r\n", 1)
+	verifications, err := VerifyWithOptions(strings.NewReader(signed), &VerifyOptions{HeaderInstances: true})
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+
+	v := verifications[0]
+	if v.Err != nil {
+		t.Errorf("Expected no error when verifying signature, got: %v", v.Err)
+	}
+	if len(v.UnsignedHeaderKeys) != 0 {
+		t.Errorf("Expected no unsigned header keys, got %v", v.UnsignedHeaderKeys)
+	}
+	h, err := readHeader(bufio.NewReader(strings.NewReader(signed)))
+	if err != nil {
+		t.Fatalf("Expected no error while reading header, got: %v", err)
+	}
+	for _, inst := range v.HeaderInstances {
+		if inst.Index >= 0 && strings.HasPrefix(h[inst.Index], "Sub ject") {
+			t.Errorf("Expected the malformed field not to be picked for %v", inst)
+		}
+	}
+}
+
+func TestVerify_maxDNSLookups(t *testing.T) {
+	signers := []struct {
+		domain, selector string
+	}{
+		{"example.org", "brisbane"},
+		{"example.com", "brisbane"},
+		{"example.org", "emptyhash"},
+		{"example.org", "sha256"},
+	}
+
+	mail := mailString
+	for _, signer := range signers {
+		options := &SignOptions{
+			Domain:   signer.domain,
+			Selector: signer.selector,
+			Signer:   testPrivateKey,
+		}
+		var b bytes.Buffer
+		if err := Sign(&b, strings.NewReader(mail), options); err != nil {
+			t.Fatal("Expected no error while signing mail, got:", err)
+		}
+		mail = b.String()
+	}
+
+	verifOptions := VerifyOptions{MaxDNSLookups: 2}
+	verifications, err := VerifyWithOptions(strings.NewReader(mail), &verifOptions)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signatures, got: %v", err)
+	} else if len(verifications) != len(signers) {
+		t.Fatalf("Expected %v verifications, got %v", len(signers), len(verifications))
+	}
+
+	var valid, tempFail int
+	for _, v := range verifications {
+		switch {
+		case v.Err == nil:
+			valid++
+		case IsTempFail(v.Err) && strings.Contains(v.Err.Error(), "too many DNS lookups"):
+			tempFail++
+		default:
+			t.Errorf("Unexpected error for signature of %v: %v", v.Domain, v.Err)
+		}
+	}
+	if valid != 2 || tempFail != 2 {
+		t.Errorf("Expected 2 valid and 2 temporarily failed signatures, got %v and %v", valid, tempFail)
+	}
+}
+
+func TestStripWhitespace(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{" a b\tc\r\n d ", "abcd"},
+		{"caf\u00e9 \u00a0x", "caf\u00e9\u00a0x"},
+		{"\xe9\xff \xc3", "\xe9\xff\xc3"},
+	}
+	for _, test := range tests {
+		if got := stripWhitespace(test.in); got != test.want {
+			t.Errorf("stripWhitespace(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
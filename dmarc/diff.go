@@ -0,0 +1,96 @@
+package dmarc
+
+import (
+	"fmt"
+)
+
+// Diff compares two DMARC records and returns a list of human-readable
+// descriptions of the changes between them. An empty list is returned if the
+// records are equivalent.
+//
+// Missing "pct" and "rf" tags are compared as their default values, 100 and
+// "afrf".
+func Diff(old, newRec *Record) []string {
+	if old == nil {
+		old = &Record{}
+	}
+	if newRec == nil {
+		newRec = &Record{}
+	}
+
+	var changes []string
+	if old.Policy != newRec.Policy {
+		changes = append(changes, fmt.Sprintf("policy changed from %q to %q", old.Policy, newRec.Policy))
+	}
+	if old.SubdomainPolicy != newRec.SubdomainPolicy {
+		changes = append(changes, fmt.Sprintf("subdomain policy changed from %q to %q", old.SubdomainPolicy, newRec.SubdomainPolicy))
+	}
+	if percent(old.Percent) != percent(newRec.Percent) {
+		changes = append(changes, fmt.Sprintf("percentage changed from %v to %v", formatPercent(old.Percent), formatPercent(newRec.Percent)))
+	}
+	if old.DKIMAlignment != newRec.DKIMAlignment {
+		changes = append(changes, fmt.Sprintf("DKIM alignment changed from %q to %q", old.DKIMAlignment, newRec.DKIMAlignment))
+	}
+	if old.SPFAlignment != newRec.SPFAlignment {
+		changes = append(changes, fmt.Sprintf("SPF alignment changed from %q to %q", old.SPFAlignment, newRec.SPFAlignment))
+	}
+	if old.FailureOptions != newRec.FailureOptions {
+		changes = append(changes, "failure reporting options changed")
+	}
+	if old.ReportInterval != newRec.ReportInterval {
+		changes = append(changes, fmt.Sprintf("report interval changed from %v to %v", old.ReportInterval, newRec.ReportInterval))
+	}
+	changes = append(changes, diffList("report format", reportFormats(old), reportFormats(newRec))...)
+	changes = append(changes, diffList("aggregate report URI", old.ReportURIAggregate, newRec.ReportURIAggregate)...)
+	changes = append(changes, diffList("failure report URI", old.ReportURIFailure, newRec.ReportURIFailure)...)
+	return changes
+}
+
+func percent(pct *int) int {
+	if pct == nil {
+		return 100
+	}
+	return *pct
+}
+
+func formatPercent(pct *int) string {
+	if pct == nil {
+		return "100% (default)"
+	}
+	return fmt.Sprintf("%v%%", *pct)
+}
+
+func reportFormats(rec *Record) []string {
+	if len(rec.ReportFormat) == 0 {
+		return []string{string(ReportFormatAFRF)}
+	}
+	l := make([]string, len(rec.ReportFormat))
+	for i, f := range rec.ReportFormat {
+		l[i] = string(f)
+	}
+	return l
+}
+
+func diffList(name string, old, newList []string) []string {
+	oldSet := make(map[string]bool, len(old))
+	for _, s := range old {
+		oldSet[s] = true
+	}
+	newSet := make(map[string]bool, len(newList))
+	for _, s := range newList {
+		newSet[s] = true
+	}
+
+	var changes []string
+	for _, s := range old {
+		if !newSet[s] {
+			changes = append(changes, fmt.Sprintf("removed %v %q", name, s))
+		}
+	}
+	for _, s := range newList {
+		if !oldSet[s] {
+			changes = append(changes, fmt.Sprintf("added %v %q", name, s))
+		}
+	}
+	return changes
+}
@@ -0,0 +1,55 @@
+package dmarc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	pct := 50
+	old := &Record{
+		Policy:             PolicyNone,
+		DKIMAlignment:      AlignmentRelaxed,
+		SPFAlignment:       AlignmentRelaxed,
+		ReportURIAggregate: []string{"mailto:dmarc@example.org", "mailto:old@example.org"},
+	}
+	newRec := &Record{
+		Policy:             PolicyQuarantine,
+		DKIMAlignment:      AlignmentRelaxed,
+		SPFAlignment:       AlignmentRelaxed,
+		Percent:            &pct,
+		ReportURIAggregate: []string{"mailto:dmarc@example.org", "mailto:new@example.org"},
+	}
+
+	want := []string{
+		`policy changed from "none" to "quarantine"`,
+		`percentage changed from 100% (default) to 50%`,
+		`removed aggregate report URI "mailto:old@example.org"`,
+		`added aggregate report URI "mailto:new@example.org"`,
+	}
+	if changes := Diff(old, newRec); !reflect.DeepEqual(changes, want) {
+		t.Errorf("Expected changes to be \n%q\n but got \n%q", want, changes)
+	}
+
+	if changes := Diff(old, old); len(changes) != 0 {
+		t.Errorf("Expected no changes, got %q", changes)
+	}
+
+	// Defaults are equivalent to explicit values
+	pct = 100
+	explicit := *old
+	explicit.Percent = &pct
+	explicit.ReportFormat = []ReportFormat{ReportFormatAFRF}
+	if changes := Diff(old, &explicit); len(changes) != 0 {
+		t.Errorf("Expected no changes between default and explicit values, got %q", changes)
+	}
+
+	explicit.ReportFormat = []ReportFormat{"iodef"}
+	want = []string{
+		`removed report format "afrf"`,
+		`added report format "iodef"`,
+	}
+	if changes := Diff(old, &explicit); !reflect.DeepEqual(changes, want) {
+		t.Errorf("Expected changes to be \n%q\n but got \n%q", want, changes)
+	}
+}
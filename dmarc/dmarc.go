@@ -2,7 +2,10 @@
 package dmarc
 
 import (
+	"fmt"
 	"time"
+
+	"golang.org/x/net/publicsuffix"
 )
 
 type AlignmentMode string
@@ -36,6 +39,9 @@ const (
 )
 
 // Record is a DMARC record, as defined in RFC 7489 section 6.3.
+//
+// When the "adkim" or "aspf" tags are absent, Parse sets DKIMAlignment and
+// SPFAlignment to their default value, AlignmentRelaxed.
 type Record struct {
 	DKIMAlignment      AlignmentMode  // "adkim"
 	SPFAlignment       AlignmentMode  // "aspf"
@@ -48,3 +54,17 @@ type Record struct {
 	ReportURIFailure   []string       // "ruf"
 	SubdomainPolicy    Policy         // "sp"
 }
+
+// OrgDomain returns the organizational domain of a domain name, as defined in
+// RFC 7489 section 3.2. The public suffix list, including its private
+// section, is used to find the domain's public suffix.
+//
+// An error is returned if the domain is itself a public suffix.
+func OrgDomain(domain string) (string, error) {
+	domain = normalizeDomain(domain)
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return "", fmt.Errorf("dmarc: failed to determine organizational domain for %q: %v", domain, err)
+	}
+	return org, nil
+}
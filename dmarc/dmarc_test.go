@@ -0,0 +1,34 @@
+package dmarc
+
+import (
+	"testing"
+)
+
+func TestOrgDomain(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		{"example.com", "example.com"},
+		{"mail.example.com", "example.com"},
+		{"mail.example.co.uk", "example.co.uk"},
+		{"MAIL.Example.COM.", "example.com"},
+		// Private section of the public suffix list
+		{"foo.bar.github.io", "bar.github.io"},
+		// Unknown TLDs
+		{"mail.example.unknowntld", "example.unknowntld"},
+	}
+
+	for _, test := range tests {
+		org, err := OrgDomain(test.domain)
+		if err != nil {
+			t.Errorf("Expected no error while computing organizational domain of %q, got: %v", test.domain, err)
+		} else if org != test.want {
+			t.Errorf("Expected organizational domain of %q to be %q, got %q", test.domain, test.want, org)
+		}
+	}
+
+	if _, err := OrgDomain("co.uk"); err == nil {
+		t.Errorf("Expected an error for a public suffix")
+	}
+}
@@ -0,0 +1,114 @@
+package dmarc
+
+import (
+	"strings"
+)
+
+// Evaluation is the result of a DMARC policy evaluation for a message, as
+// defined in RFC 7489 section 6.6.
+type Evaluation struct {
+	// The RFC5322.From domain of the message.
+	Domain string
+	// The domain the DMARC record was found at. It's either Domain or its
+	// organizational domain.
+	PolicyDomain string
+	// The DMARC record.
+	Record *Record
+
+	// Whether an authenticated DKIM identifier is aligned with Domain.
+	DKIMAligned bool
+	// Whether an authenticated SPF identifier is aligned with Domain.
+	SPFAligned bool
+
+	// The policy to apply to the message if it doesn't pass DMARC.
+	Policy Policy
+	// Whether Policy is the subdomain policy of the record ("sp") rather
+	// than its domain policy ("p"). The subdomain policy is applied when the
+	// record was found at the organizational domain of Domain.
+	SubdomainPolicyApplied bool
+}
+
+// Pass returns true if the message passes DMARC, that is, if at least one
+// authenticated identifier is aligned.
+func (ev *Evaluation) Pass() bool {
+	return ev.DKIMAligned || ev.SPFAligned
+}
+
+// Evaluate looks up the DMARC policy for the RFC5322.From domain of a message
+// and checks it against the domains which passed DKIM and SPF authentication.
+//
+// If no DMARC record is found for the domain nor for its organizational
+// domain, ErrNoPolicy is returned.
+func Evaluate(fromDomain string, dkimDomains, spfDomains []string, options *LookupOptions) (*Evaluation, error) {
+	fromDomain = normalizeDomain(fromDomain)
+
+	policyDomain := fromDomain
+	rec, err := LookupWithOptions(policyDomain, options)
+	if err == ErrNoPolicy {
+		org, orgErr := OrgDomain(fromDomain)
+		if orgErr != nil {
+			return nil, orgErr
+		}
+		if org != fromDomain {
+			policyDomain = org
+			rec, err = LookupWithOptions(policyDomain, options)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ev := &Evaluation{
+		Domain:       fromDomain,
+		PolicyDomain: policyDomain,
+		Record:       rec,
+		Policy:       rec.Policy,
+	}
+	if policyDomain != fromDomain && rec.SubdomainPolicy != "" {
+		ev.Policy = rec.SubdomainPolicy
+		ev.SubdomainPolicyApplied = true
+	}
+
+	for _, d := range dkimDomains {
+		if isAligned(fromDomain, d, rec.DKIMAlignment) {
+			ev.DKIMAligned = true
+			break
+		}
+	}
+	for _, d := range spfDomains {
+		if isAligned(fromDomain, d, rec.SPFAlignment) {
+			ev.SPFAligned = true
+			break
+		}
+	}
+
+	return ev, nil
+}
+
+// IsAligned reports whether domain is aligned with fromDomain, the domain of
+// the RFC5322.From header field, as defined in RFC 7489 section 3.1. Domains
+// are compared case-insensitively, ignoring a trailing dot.
+func IsAligned(fromDomain, domain string, mode AlignmentMode) bool {
+	return isAligned(normalizeDomain(fromDomain), domain, mode)
+}
+
+func isAligned(fromDomain, domain string, mode AlignmentMode) bool {
+	domain = normalizeDomain(domain)
+	if mode == AlignmentStrict {
+		return domain == fromDomain
+	}
+
+	fromOrg, err := OrgDomain(fromDomain)
+	if err != nil {
+		return false
+	}
+	org, err := OrgDomain(domain)
+	if err != nil {
+		return false
+	}
+	return fromOrg == org
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
@@ -0,0 +1,75 @@
+package dmarc
+
+import (
+	"net"
+	"testing"
+)
+
+func TestEvaluate_subdomainPolicy(t *testing.T) {
+	records := map[string]string{
+		"_dmarc.example.com": "v=DMARC1; p=reject; sp=quarantine",
+		"_dmarc.example.org": "v=DMARC1; p=reject",
+	}
+	options := &LookupOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			if txt, ok := records[domain]; ok {
+				return []string{txt}, nil
+			}
+			return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+		},
+	}
+
+	tests := []struct {
+		domain       string
+		policyDomain string
+		policy       Policy
+		subdomain    bool
+	}{
+		{"example.com", "example.com", PolicyReject, false},
+		{"mail.example.com", "example.com", PolicyQuarantine, true},
+		// Without "sp", the domain policy applies to subdomains
+		{"mail.example.org", "example.org", PolicyReject, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.domain, func(t *testing.T) {
+			ev, err := Evaluate(test.domain, nil, nil, options)
+			if err != nil {
+				t.Fatalf("Expected no error while evaluating policy, got: %v", err)
+			}
+			if ev.PolicyDomain != test.policyDomain {
+				t.Errorf("Expected policy domain to be %v, got %v", test.policyDomain, ev.PolicyDomain)
+			}
+			if ev.Policy != test.policy {
+				t.Errorf("Expected policy to be %v, got %v", test.policy, ev.Policy)
+			}
+			if ev.SubdomainPolicyApplied != test.subdomain {
+				t.Errorf("Expected SubdomainPolicyApplied to be %v, got %v", test.subdomain, ev.SubdomainPolicyApplied)
+			}
+			if ev.Record.Policy != PolicyReject {
+				t.Errorf("Expected published policy to be %v, got %v", PolicyReject, ev.Record.Policy)
+			}
+		})
+	}
+}
+
+func TestIsAligned(t *testing.T) {
+	tests := []struct {
+		fromDomain, domain string
+		mode               AlignmentMode
+		want               bool
+	}{
+		{"example.com", "example.com", AlignmentStrict, true},
+		{"Example.COM.", "example.com", AlignmentStrict, true},
+		{"example.com", "mail.example.com", AlignmentStrict, false},
+		{"example.com", "mail.example.com", AlignmentRelaxed, true},
+		{"mail.example.com.", "Example.com.", AlignmentRelaxed, true},
+		{"example.com", "example.org", AlignmentRelaxed, false},
+		{"co.uk", "example.co.uk", AlignmentRelaxed, false},
+	}
+	for _, test := range tests {
+		if got := IsAligned(test.fromDomain, test.domain, test.mode); got != test.want {
+			t.Errorf("IsAligned(%q, %q, %q) = %v, want %v", test.fromDomain, test.domain, test.mode, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package dmarc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-msgauth/authres"
+)
+
+// FailureReport contains the information included in a DMARC failure report,
+// as defined in RFC 7489 section 7.3.
+type FailureReport struct {
+	// The address of the report sender and of the recipients.
+	From string
+	To   []string
+	// The date of the report. If zero, the current time is used.
+	Date time.Time
+
+	// The DMARC evaluation of the reported message.
+	Evaluation *Evaluation
+
+	// The authentication results for the reported message. Identity is the
+	// authserv-id of the Authentication-Results field.
+	Identity    string
+	AuthResults []authres.Result
+
+	// The RFC5321.MailFrom address of the reported message.
+	OriginalMailFrom string
+	// The IP address of the client which sent the reported message.
+	SourceIP net.IP
+	// The time the reported message was received.
+	ArrivalDate time.Time
+	// The final disposition of the message, as defined in RFC 6591 section
+	// 3.1: one of "delivered", "spam", "policy", "reject" or "other". If
+	// empty, it's derived from the policy of the evaluation.
+	DeliveryResult string
+
+	// By default, the body of the reported message is redacted and only its
+	// header is included. If IncludeBody is set, the whole message is
+	// included.
+	IncludeBody bool
+}
+
+func (report *FailureReport) deliveryResult() string {
+	if report.DeliveryResult != "" {
+		return report.DeliveryResult
+	}
+	switch report.Evaluation.Policy {
+	case PolicyReject:
+		return "reject"
+	case PolicyQuarantine:
+		return "spam"
+	default:
+		return "delivered"
+	}
+}
+
+func (report *FailureReport) identityAlignment() string {
+	var l []string
+	if report.Evaluation.DKIMAligned {
+		l = append(l, "dkim")
+	}
+	if report.Evaluation.SPFAligned {
+		l = append(l, "spf")
+	}
+	if len(l) == 0 {
+		return "none"
+	}
+	return strings.Join(l, ", ")
+}
+
+// WriteFailureReport writes a DMARC failure report for the message msg in
+// the Abuse Reporting Format (ARF, RFC 5965 and RFC 6591). The report is a
+// complete message with a multipart/report body.
+func WriteFailureReport(w io.Writer, report *FailureReport, msg io.Reader) error {
+	if report.Evaluation == nil {
+		return fmt.Errorf("dmarc: missing evaluation in failure report")
+	}
+
+	date := report.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	mw := multipart.NewWriter(w)
+
+	var hdr bytes.Buffer
+	writeField(&hdr, "From", report.From)
+	writeField(&hdr, "To", strings.Join(report.To, ", "))
+	writeField(&hdr, "Date", date.Format(time.RFC1123Z))
+	writeField(&hdr, "Subject", "DMARC failure report for "+report.Evaluation.Domain)
+	writeField(&hdr, "MIME-Version", "1.0")
+	writeField(&hdr, "Content-Type", "multipart/report; report-type=feedback-report; boundary=\""+mw.Boundary()+"\"")
+	hdr.WriteString("\r\n")
+	if _, err := w.Write(hdr.Bytes()); err != nil {
+		return err
+	}
+
+	// Human-readable part
+	pw, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return err
+	}
+	text := "This is an authentication failure report for an email message"
+	if report.SourceIP != nil {
+		text += " received from IP " + report.SourceIP.String()
+	}
+	text += ", claiming to be from the domain " + report.Evaluation.Domain + ".\r\n"
+	if _, err := io.WriteString(pw, text); err != nil {
+		return err
+	}
+
+	// Machine-readable part
+	pw, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"message/feedback-report"},
+	})
+	if err != nil {
+		return err
+	}
+	var fr bytes.Buffer
+	writeField(&fr, "Feedback-Type", "auth-failure")
+	writeField(&fr, "User-Agent", "go-msgauth")
+	writeField(&fr, "Version", "1")
+	if report.OriginalMailFrom != "" {
+		writeField(&fr, "Original-Mail-From", "<"+report.OriginalMailFrom+">")
+	}
+	if !report.ArrivalDate.IsZero() {
+		writeField(&fr, "Arrival-Date", report.ArrivalDate.Format(time.RFC1123Z))
+	}
+	if report.SourceIP != nil {
+		writeField(&fr, "Source-IP", report.SourceIP.String())
+	}
+	writeField(&fr, "Reported-Domain", report.Evaluation.Domain)
+	if report.Identity != "" {
+		writeField(&fr, "Authentication-Results", authres.Format(report.Identity, report.AuthResults))
+	}
+	writeField(&fr, "Auth-Failure", "dmarc")
+	writeField(&fr, "Delivery-Result", report.deliveryResult())
+	writeField(&fr, "Identity-Alignment", report.identityAlignment())
+	if _, err := pw.Write(fr.Bytes()); err != nil {
+		return err
+	}
+
+	// Original message
+	contentType := "text/rfc822-headers"
+	if report.IncludeBody {
+		contentType = "message/rfc822"
+	}
+	pw, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {contentType},
+	})
+	if err != nil {
+		return err
+	}
+	if report.IncludeBody {
+		_, err = io.Copy(pw, msg)
+	} else {
+		err = copyHeader(pw, msg)
+	}
+	if err != nil {
+		return err
+	}
+
+	return mw.Close()
+}
+
+func writeField(buf *bytes.Buffer, k, v string) {
+	buf.WriteString(k)
+	buf.WriteString(": ")
+	buf.WriteString(v)
+	buf.WriteString("\r\n")
+}
+
+// copyHeader copies the header of the message read from r to w, stopping at
+// the empty line separating it from the body.
+func copyHeader(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		l, err := br.ReadString('\n')
+		if strings.TrimRight(l, "\r\n") == "" {
+			if err == io.EOF {
+				err = nil
+			}
+			return err
+		}
+		if _, werr := io.WriteString(w, l); werr != nil {
+			return werr
+		}
+		if err == io.EOF {
+			_, err = io.WriteString(w, "\r\n")
+			return err
+		} else if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package dmarc
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-msgauth/authres"
+)
+
+const failureReportMessage = "From: Joe SixPack <joe@example.com>\r\n" +
+	"To: Suzie Q <suzie@example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"\r\n" +
+	"Hi.\r\n"
+
+func TestWriteFailureReport(t *testing.T) {
+	report := &FailureReport{
+		From: "dmarc-reports@example.net",
+		To:   []string{"dmarc-failures@example.com"},
+		Date: time.Date(2021, 3, 15, 16, 21, 24, 0, time.UTC),
+		Evaluation: &Evaluation{
+			Domain:       "example.com",
+			PolicyDomain: "example.com",
+			Record:       &Record{Policy: PolicyReject},
+			Policy:       PolicyReject,
+		},
+		Identity: "mx.example.net",
+		AuthResults: []authres.Result{
+			&authres.SPFResult{Value: authres.ResultFail, From: "example.org"},
+			&authres.DMARCResult{Value: authres.ResultFail, From: "example.com"},
+		},
+		OriginalMailFrom: "bounce@example.org",
+		SourceIP:         net.ParseIP("192.0.2.1"),
+	}
+
+	var b bytes.Buffer
+	if err := WriteFailureReport(&b, report, strings.NewReader(failureReportMessage)); err != nil {
+		t.Fatalf("WriteFailureReport() = %v", err)
+	}
+
+	m, err := mail.ReadMessage(&b)
+	if err != nil {
+		t.Fatalf("failed to read report: %v", err)
+	}
+	if s := m.Header.Get("To"); s != "dmarc-failures@example.com" {
+		t.Errorf("To = %q", s)
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("failed to parse Content-Type: %v", err)
+	}
+	if mediaType != "multipart/report" || params["report-type"] != "feedback-report" {
+		t.Fatalf("Content-Type = %v %v, want multipart/report with report-type=feedback-report", mediaType, params)
+	}
+
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	var types []string
+	var feedback textproto.MIMEHeader
+	var original []byte
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("failed to read part: %v", err)
+		}
+
+		typ := p.Header.Get("Content-Type")
+		types = append(types, typ)
+		switch typ {
+		case "message/feedback-report":
+			r := io.MultiReader(p, strings.NewReader("\r\n"))
+			feedback, err = textproto.NewReader(bufio.NewReader(r)).ReadMIMEHeader()
+			if err != nil {
+				t.Fatalf("failed to read feedback report: %v", err)
+			}
+		case "text/rfc822-headers":
+			original, err = io.ReadAll(p)
+			if err != nil {
+				t.Fatalf("failed to read original message: %v", err)
+			}
+		}
+	}
+
+	wantTypes := []string{"text/plain; charset=utf-8", "message/feedback-report", "text/rfc822-headers"}
+	if strings.Join(types, ",") != strings.Join(wantTypes, ",") {
+		t.Fatalf("parts = %q, want %q", types, wantTypes)
+	}
+
+	wantFeedback := map[string]string{
+		"Feedback-Type":          "auth-failure",
+		"Version":                "1",
+		"Original-Mail-From":     "<bounce@example.org>",
+		"Source-Ip":              "192.0.2.1",
+		"Reported-Domain":        "example.com",
+		"Authentication-Results": "mx.example.net; spf=fail smtp.mailfrom=example.org; dmarc=fail header.from=example.com",
+		"Auth-Failure":           "dmarc",
+		"Delivery-Result":        "reject",
+		"Identity-Alignment":     "none",
+	}
+	for k, want := range wantFeedback {
+		if v := feedback.Get(k); v != want {
+			t.Errorf("feedback report field %v = %q, want %q", k, v, want)
+		}
+	}
+
+	wantOriginal := strings.SplitAfter(failureReportMessage, "\r\n\r\n")[0]
+	wantOriginal = strings.TrimSuffix(wantOriginal, "\r\n")
+	if string(original) != wantOriginal {
+		t.Errorf("original message = %q, want %q", original, wantOriginal)
+	}
+}
+
+func TestWriteFailureReport_includeBody(t *testing.T) {
+	report := &FailureReport{
+		From: "dmarc-reports@example.net",
+		To:   []string{"dmarc-failures@example.com"},
+		Evaluation: &Evaluation{
+			Domain:      "example.com",
+			DKIMAligned: true,
+			Policy:      PolicyNone,
+		},
+		IncludeBody: true,
+	}
+
+	var b bytes.Buffer
+	if err := WriteFailureReport(&b, report, strings.NewReader(failureReportMessage)); err != nil {
+		t.Fatalf("WriteFailureReport() = %v", err)
+	}
+
+	s := b.String()
+	for _, want := range []string{
+		"Content-Type: message/rfc822\r\n\r\n" + failureReportMessage,
+		"Delivery-Result: delivered\r\n",
+		"Identity-Alignment: dkim\r\n",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("report doesn't contain %q:\n%v", want, s)
+		}
+	}
+}
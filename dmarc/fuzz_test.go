@@ -0,0 +1,38 @@
+package dmarc
+
+import (
+	"testing"
+)
+
+func FuzzDMARCParse(f *testing.F) {
+	f.Add("v=DMARC1; p=none")
+	f.Add("v=DMARC1; p=reject; sp=quarantine; adkim=s; aspf=r; pct=50; ri=3600")
+	f.Add("v=DMARC1; p= reject ; rua= mailto:a@example.com , mailto:c@example.net ; fo=0 : 1 : d; rf= afrf ")
+	f.Add("v=DMARC1; p=none; rua=mailto:a@example.com,mailto:b@example.com,; ruf=mailto:c@example.com")
+
+	f.Fuzz(func(t *testing.T, txt string) {
+		rec, err := Parse(txt)
+		if err != nil {
+			return
+		}
+
+		switch rec.Policy {
+		case PolicyNone, PolicyQuarantine, PolicyReject:
+		default:
+			t.Errorf("Parse(%q) policy = %q", txt, rec.Policy)
+		}
+		if rec.Percent != nil && (*rec.Percent < 0 || *rec.Percent > 100) {
+			t.Errorf("Parse(%q) percent = %v", txt, *rec.Percent)
+		}
+		if len(rec.ReportURIAggregate) > maxReportURIs || len(rec.ReportURIFailure) > maxReportURIs {
+			t.Errorf("Parse(%q) returned too many report URIs", txt)
+		}
+		for _, l := range [][]string{rec.ReportURIAggregate, rec.ReportURIFailure} {
+			for _, u := range l {
+				if u == "" {
+					t.Errorf("Parse(%q) returned an empty report URI", txt)
+				}
+			}
+		}
+	})
+}
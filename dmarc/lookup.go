@@ -36,30 +36,69 @@ func Lookup(domain string) (*Record, error) {
 }
 
 func LookupWithOptions(domain string, options *LookupOptions) (*Record, error) {
-	var txts []string
-	var err error
-	if options != nil && options.LookupTXT != nil {
-		txts, err = options.LookupTXT("_dmarc." + domain)
-	} else {
-		txts, err = net.LookupTXT("_dmarc." + domain)
-	}
-	if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+	txts, err := lookupTXT("_dmarc."+domain, options)
+	if isNotFoundError(err) {
+		return nil, ErrNoPolicy
+	} else if isTempLookupError(err) {
 		return nil, tempFailError("TXT record unavailable: " + err.Error())
 	} else if err != nil {
-		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
-			return nil, ErrNoPolicy
-		}
 		return nil, errors.New("dmarc: failed to lookup TXT record: " + err.Error())
 	}
-	if len(txts) == 0 {
-		return nil, ErrNoPolicy
-	}
 
-	// Long keys are split in multiple parts
-	txt := strings.Join(txts, "")
+	txt, err := SelectRecord(txts)
+	if err != nil {
+		return nil, err
+	}
 	return Parse(txt)
 }
 
+// SelectRecord selects the DMARC record among the TXT records found for a
+// domain. As defined in RFC 7489 section 6.6.3, records which don't start with
+// a "v=DMARC1" tag are discarded, and ErrNoPolicy is returned if no record or
+// several records remain. Strings of a single record are expected to be
+// already concatenated, as done by net.LookupTXT.
+func SelectRecord(txts []string) (string, error) {
+	var txt string
+	n := 0
+	for _, t := range txts {
+		if isDMARCRecord(t) {
+			txt = t
+			n++
+		}
+	}
+	if n != 1 {
+		return "", ErrNoPolicy
+	}
+	return txt, nil
+}
+
+// isDMARCRecord checks whether a TXT record starts with a "v=DMARC1" tag.
+func isDMARCRecord(txt string) bool {
+	tag, _, _ := strings.Cut(txt, ";")
+	k, v, ok := strings.Cut(tag, "=")
+	return ok && strings.TrimSpace(k) == "v" && strings.TrimSpace(v) == "DMARC1"
+}
+
+// isNotFoundError reports whether err means that the queried name has no TXT
+// record, in which case there is no policy to apply.
+func isNotFoundError(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// isTempLookupError reports whether the TXT lookup may succeed if retried.
+func isTempLookupError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Temporary()
+}
+
+func lookupTXT(domain string, options *LookupOptions) ([]string, error) {
+	if options != nil && options.LookupTXT != nil {
+		return options.LookupTXT(domain)
+	}
+	return net.LookupTXT(domain)
+}
+
 func Parse(txt string) (*Record, error) {
 	params, err := parseParams(txt)
 	if err != nil {
@@ -116,14 +155,11 @@ func Parse(txt string) (*Record, error) {
 	}
 
 	if rf, ok := params["rf"]; ok {
-		l := strings.Split(rf, ":")
-		rec.ReportFormat = make([]ReportFormat, len(l))
-		for i, f := range l {
-			switch f {
-			case "afrf":
-				rec.ReportFormat[i] = ReportFormat(f)
-			default:
-				return nil, errors.New("dmarc: invalid parameter 'rf'")
+		// RFC 7489 section 6.3: unknown report formats are ignored
+		for _, f := range strings.Split(rf, ":") {
+			switch f := ReportFormat(strings.TrimSpace(f)); f {
+			case ReportFormatAFRF:
+				rec.ReportFormat = append(rec.ReportFormat, f)
 			}
 		}
 	}
@@ -212,10 +248,21 @@ func parseFailureOptions(s string) (FailureOptions, error) {
 	return opts, nil
 }
 
+// maxReportURIs is the maximum number of URIs parsed from a "rua" or "ruf"
+// parameter. RFC 7489 section 6.2 allows receivers to impose such a limit.
+const maxReportURIs = 32
+
 func parseURIList(s string) []string {
-	l := strings.Split(s, ",")
-	for i, u := range l {
-		l[i] = strings.TrimSpace(u)
+	var l []string
+	for _, u := range strings.Split(s, ",") {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		if len(l) >= maxReportURIs {
+			break
+		}
+		l = append(l, u)
 	}
 	return l
 }
@@ -0,0 +1,194 @@
+package dmarc
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse_whitespace(t *testing.T) {
+	txt := "v=DMARC1; p= reject ;" +
+		" rua= mailto:a@example.com , mailto:c@example.net ;" +
+		" fo=0 : 1 : d; rf= afrf "
+
+	rec, err := Parse(txt)
+	if err != nil {
+		t.Fatalf("Expected no error while parsing record, got: %v", err)
+	}
+
+	want := &Record{
+		DKIMAlignment:      AlignmentRelaxed,
+		SPFAlignment:       AlignmentRelaxed,
+		FailureOptions:     FailureAll | FailureAny | FailureDKIM,
+		Policy:             PolicyReject,
+		ReportFormat:       []ReportFormat{ReportFormatAFRF},
+		ReportURIAggregate: []string{"mailto:a@example.com", "mailto:c@example.net"},
+	}
+	if !reflect.DeepEqual(rec, want) {
+		t.Errorf("Expected record to be \n%+v\n but got \n%+v", want, rec)
+	}
+}
+
+func TestParse_reportURIs(t *testing.T) {
+	rec, err := Parse("v=DMARC1; p=none; rua=mailto:a@example.com,mailto:b@example.com,; ruf=mailto:c@example.com")
+	if err != nil {
+		t.Fatalf("Expected no error while parsing record, got: %v", err)
+	}
+	want := []string{"mailto:a@example.com", "mailto:b@example.com"}
+	if !reflect.DeepEqual(rec.ReportURIAggregate, want) {
+		t.Errorf("Expected aggregate report URIs to be %v, got %v", want, rec.ReportURIAggregate)
+	}
+	want = []string{"mailto:c@example.com"}
+	if !reflect.DeepEqual(rec.ReportURIFailure, want) {
+		t.Errorf("Expected failure report URIs to be %v, got %v", want, rec.ReportURIFailure)
+	}
+
+	uris := make([]string, 1000)
+	for i := range uris {
+		uris[i] = fmt.Sprintf("mailto:dmarc%v@example.com", i)
+	}
+	rec, err = Parse("v=DMARC1; p=none; rua=" + strings.Join(uris, ","))
+	if err != nil {
+		t.Fatalf("Expected no error while parsing record, got: %v", err)
+	}
+	if !reflect.DeepEqual(rec.ReportURIAggregate, uris[:maxReportURIs]) {
+		t.Errorf("Expected aggregate report URIs to be truncated to %v entries, got %v", maxReportURIs, len(rec.ReportURIAggregate))
+	}
+}
+
+func TestParse_reportFormat(t *testing.T) {
+	rec, err := Parse("v=DMARC1; p=none; rf=afrf:iodef")
+	if err != nil {
+		t.Fatalf("Expected no error while parsing record, got: %v", err)
+	}
+	want := []ReportFormat{ReportFormatAFRF}
+	if !reflect.DeepEqual(rec.ReportFormat, want) {
+		t.Errorf("Expected report formats to be %v, got %v", want, rec.ReportFormat)
+	}
+
+	rec, err = Parse("v=DMARC1; p=none; rf=iodef")
+	if err != nil {
+		t.Fatalf("Expected no error while parsing record, got: %v", err)
+	}
+	if len(rec.ReportFormat) != 0 {
+		t.Errorf("Expected no report format, got %v", rec.ReportFormat)
+	}
+}
+
+func TestParse_defaultAlignment(t *testing.T) {
+	rec, err := Parse("v=DMARC1; p=none")
+	if err != nil {
+		t.Fatalf("Expected no error while parsing record, got: %v", err)
+	}
+	if rec.DKIMAlignment != AlignmentRelaxed {
+		t.Errorf("Expected DKIM alignment to default to %q, got %q", AlignmentRelaxed, rec.DKIMAlignment)
+	}
+	if rec.SPFAlignment != AlignmentRelaxed {
+		t.Errorf("Expected SPF alignment to default to %q, got %q", AlignmentRelaxed, rec.SPFAlignment)
+	}
+}
+
+func TestParse_policy(t *testing.T) {
+	tests := []struct {
+		p    string
+		want Policy
+		ok   bool
+	}{
+		{"reject", PolicyReject, true},
+		{"rejectx", "", false},
+		{" reject", PolicyReject, true},
+		{"reject ", PolicyReject, true},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		txt := "v=DMARC1; p=" + test.p
+
+		// Parse and LookupWithOptions must behave the same way
+		lookupTXT := func(domain string) ([]string, error) {
+			return []string{txt}, nil
+		}
+		lookupRec, lookupErr := LookupWithOptions("example.org", &LookupOptions{LookupTXT: lookupTXT})
+		parseRec, parseErr := Parse(txt)
+
+		for _, res := range []struct {
+			name string
+			rec  *Record
+			err  error
+		}{
+			{"Parse", parseRec, parseErr},
+			{"LookupWithOptions", lookupRec, lookupErr},
+		} {
+			if !test.ok {
+				if res.err == nil {
+					t.Errorf("%v(%q): expected an error", res.name, txt)
+				}
+				continue
+			}
+			if res.err != nil {
+				t.Errorf("%v(%q) = %v", res.name, txt, res.err)
+			} else if res.rec.Policy != test.want {
+				t.Errorf("%v(%q): expected policy %q, got %q", res.name, txt, test.want, res.rec.Policy)
+			}
+		}
+	}
+}
+
+func TestLookupWithOptions_multipleRecords(t *testing.T) {
+	tests := []struct {
+		name string
+		txts []string
+		want Policy
+	}{
+		{"other record", []string{"v=spf1 -all", "v=DMARC1; p=reject"}, PolicyReject},
+		{"whitespace", []string{"v=spf1 -all", "v = DMARC1 ; p=quarantine"}, PolicyQuarantine},
+		{"no DMARC record", []string{"v=spf1 -all", "hello"}, ""},
+		{"several DMARC records", []string{"v=DMARC1; p=reject", "v=DMARC1; p=none"}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := &LookupOptions{
+				LookupTXT: func(domain string) ([]string, error) {
+					return test.txts, nil
+				},
+			}
+			rec, err := LookupWithOptions("example.org", options)
+			if test.want == "" {
+				if err != ErrNoPolicy {
+					t.Errorf("Expected ErrNoPolicy, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error while looking up record, got: %v", err)
+			} else if rec.Policy != test.want {
+				t.Errorf("Expected policy to be %v, got %v", test.want, rec.Policy)
+			}
+		})
+	}
+}
+
+func TestSelectRecord(t *testing.T) {
+	tests := []struct {
+		txts []string
+		want string
+	}{
+		{[]string{"v=spf1 -all", "v=DMARC1; p=none"}, "v=DMARC1; p=none"},
+		{[]string{"p=none; v=DMARC1", " v = DMARC1 ; p=reject"}, " v = DMARC1 ; p=reject"},
+		{[]string{"v=DMARC10; p=none"}, ""},
+		{[]string{"v=DMARC1; p=none", "v=DMARC1; p=reject"}, ""},
+		{nil, ""},
+	}
+	for _, test := range tests {
+		txt, err := SelectRecord(test.txts)
+		if test.want == "" {
+			if err != ErrNoPolicy {
+				t.Errorf("SelectRecord(%q) = %q, %v, want ErrNoPolicy", test.txts, txt, err)
+			}
+		} else if err != nil || txt != test.want {
+			t.Errorf("SelectRecord(%q) = %q, %v, want %q", test.txts, txt, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package dmarc
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// AuthorizedURI is a report URI along with its authorization status.
+type AuthorizedURI struct {
+	URI string
+	// Authorized is true if the destination accepts reports for the policy
+	// domain, as defined in RFC 7489 section 7.1.
+	Authorized bool
+}
+
+// ReportDestinations returns the aggregate ("rua") and failure ("ruf") report
+// URIs of the record, and checks whether each of them is authorized to
+// receive reports for policyDomain.
+//
+// A destination is authorized if it belongs to the same organizational domain
+// as policyDomain, or if it publishes a "<policyDomain>._report._dmarc" TXT
+// record (external destination verification, RFC 7489 section 7.1).
+func (rec *Record) ReportDestinations(policyDomain string, options *LookupOptions) ([]AuthorizedURI, error) {
+	var uris []string
+	uris = append(uris, rec.ReportURIAggregate...)
+	uris = append(uris, rec.ReportURIFailure...)
+
+	dests := make([]AuthorizedURI, 0, len(uris))
+	for _, uri := range uris {
+		ok, err := isReportDestinationAuthorized(policyDomain, uri, options)
+		if err != nil {
+			return nil, err
+		}
+		dests = append(dests, AuthorizedURI{URI: uri, Authorized: ok})
+	}
+	return dests, nil
+}
+
+func isReportDestinationAuthorized(policyDomain, uri string, options *LookupOptions) (bool, error) {
+	destDomain, err := reportURIDomain(uri)
+	if err != nil {
+		return false, err
+	}
+
+	policyOrg, err := OrgDomain(policyDomain)
+	if err != nil {
+		return false, err
+	}
+	destOrg, err := OrgDomain(destDomain)
+	if err != nil {
+		return false, err
+	}
+	if policyOrg == destOrg {
+		return true, nil
+	}
+
+	txts, err := lookupTXT(policyDomain+"._report._dmarc."+destDomain, options)
+	if isNotFoundError(err) {
+		return false, nil
+	} else if isTempLookupError(err) {
+		return false, tempFailError("TXT record unavailable: " + err.Error())
+	} else if err != nil {
+		return false, fmt.Errorf("dmarc: failed to lookup TXT record: %v", err)
+	}
+
+	for _, txt := range txts {
+		if isDMARCRecord(txt) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// reportURIDomain extracts the destination domain from a report URI.
+func reportURIDomain(uri string) (string, error) {
+	// RFC 7489 section 6.4: a size limit can be appended with "!"
+	if i := strings.LastIndexByte(uri, '!'); i >= 0 {
+		uri = uri[:i]
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("dmarc: malformed report URI %q: %v", uri, err)
+	}
+
+	var domain string
+	switch strings.ToLower(u.Scheme) {
+	case "mailto":
+		addr := u.Opaque
+		if i := strings.IndexByte(addr, '?'); i >= 0 {
+			addr = addr[:i]
+		}
+		_, domain, _ = strings.Cut(addr, "@")
+	default:
+		domain = u.Hostname()
+	}
+	if domain == "" {
+		return "", fmt.Errorf("dmarc: missing domain in report URI %q", uri)
+	}
+	return strings.ToLower(domain), nil
+}
@@ -0,0 +1,129 @@
+package dmarc
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestRecord_ReportDestinations(t *testing.T) {
+	rec := &Record{
+		ReportURIAggregate: []string{
+			"mailto:dmarc@example.com",
+			"mailto:reports@thirdparty.example.net!10m",
+		},
+		ReportURIFailure: []string{
+			"mailto:forensic@mail.example.com",
+			"mailto:forensic@untrusted.example.org",
+		},
+	}
+
+	options := &LookupOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			switch domain {
+			case "example.com._report._dmarc.thirdparty.example.net":
+				return []string{"v=DMARC1"}, nil
+			default:
+				return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+			}
+		},
+	}
+
+	dests, err := rec.ReportDestinations("example.com", options)
+	if err != nil {
+		t.Fatalf("Expected no error while checking report destinations, got: %v", err)
+	}
+
+	want := []AuthorizedURI{
+		{URI: "mailto:dmarc@example.com", Authorized: true},
+		{URI: "mailto:reports@thirdparty.example.net!10m", Authorized: true},
+		{URI: "mailto:forensic@mail.example.com", Authorized: true},
+		{URI: "mailto:forensic@untrusted.example.org", Authorized: false},
+	}
+	if !reflect.DeepEqual(dests, want) {
+		t.Errorf("Expected report destinations to be \n%+v\n but got \n%+v", want, dests)
+	}
+}
+
+func TestRecord_ReportDestinations_tempFail(t *testing.T) {
+	rec := &Record{
+		ReportURIAggregate: []string{"mailto:reports@thirdparty.example.net"},
+	}
+
+	options := &LookupOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			return nil, &net.DNSError{Err: "server misbehaving", Name: domain, IsTemporary: true}
+		},
+	}
+
+	if _, err := rec.ReportDestinations("example.com", options); !IsTempFail(err) {
+		t.Errorf("Expected a temporary failure, got: %v", err)
+	}
+}
+
+func TestRecord_ReportDestinations_wrappedErrors(t *testing.T) {
+	rec := &Record{
+		ReportURIAggregate: []string{"mailto:reports@thirdparty.example.net"},
+	}
+
+	tests := []struct {
+		name     string
+		err      error
+		tempFail bool
+	}{
+		{
+			name:     "temporary",
+			err:      fmt.Errorf("lookup failed: %w", &net.DNSError{Err: "i/o timeout", IsTimeout: true}),
+			tempFail: true,
+		},
+		{
+			name: "not found",
+			err:  fmt.Errorf("lookup failed: %w", &net.DNSError{Err: "no such host", IsNotFound: true}),
+		},
+	}
+
+	for _, test := range tests {
+		options := &LookupOptions{
+			LookupTXT: func(domain string) ([]string, error) {
+				return nil, test.err
+			},
+		}
+		dests, err := rec.ReportDestinations("example.com", options)
+		if test.tempFail {
+			if !IsTempFail(err) {
+				t.Errorf("%v: expected a temporary failure, got: %v", test.name, err)
+			}
+		} else if err != nil {
+			t.Errorf("%v: expected no error, got: %v", test.name, err)
+		} else if dests[0].Authorized {
+			t.Errorf("%v: expected destination not to be authorized", test.name)
+		}
+	}
+}
+
+func TestRecord_ReportDestinations_version(t *testing.T) {
+	rec := &Record{
+		ReportURIAggregate: []string{"mailto:reports@thirdparty.example.net"},
+	}
+
+	for txt, want := range map[string]bool{
+		"v=DMARC1":          true,
+		" v = DMARC1 ; x=y": true,
+		"v=DMARC10":         false,
+		"x=y; v=DMARC1":     false,
+	} {
+		options := &LookupOptions{
+			LookupTXT: func(domain string) ([]string, error) {
+				return []string{txt}, nil
+			},
+		}
+		dests, err := rec.ReportDestinations("example.com", options)
+		if err != nil {
+			t.Fatalf("Expected no error while checking report destinations, got: %v", err)
+		}
+		if dests[0].Authorized != want {
+			t.Errorf("Expected authorization for record %q to be %v, got %v", txt, want, dests[0].Authorized)
+		}
+	}
+}
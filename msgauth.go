@@ -0,0 +1,239 @@
+// Package msgauth authenticates messages with DKIM and DMARC.
+//
+// The dkim, dmarc and authres sub-packages implement the individual
+// mechanisms. This package glues them together.
+package msgauth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+)
+
+// AuthenticateOptions allows to customize the default authentication
+// behavior.
+type AuthenticateOptions struct {
+	// LookupTXT returns the DNS TXT records for the given domain name. If nil,
+	// net.LookupTXT is used.
+	LookupTXT func(domain string) ([]string, error)
+	// MaxVerifications controls the maximum number of DKIM signature
+	// verifications to perform. If zero, there is no maximum.
+	MaxVerifications int
+
+	// SPF is the SPF result for the message, if any. SPF isn't implemented by
+	// go-msgauth: callers are responsible for checking it. If the result is a
+	// pass, the SPF domain is used for DMARC alignment.
+	SPF *authres.SPFResult
+}
+
+// Authenticate checks the DKIM signatures of a message and evaluates its DMARC
+// policy. It returns the DMARC result and the results of all authentication
+// methods, including DMARC, ready to be formatted with authres.Format.
+//
+// DMARC is evaluated against the domain of the From header field. The Sender
+// header field is never used instead: if the message has no From header
+// field, the DMARC result is a permanent error.
+//
+// mailFrom is the SMTP MAIL FROM address and heloName the SMTP HELO identity.
+// They are used to determine the SPF domain for DMARC alignment. clientIP is
+// reserved for SPF evaluation, which is not implemented yet.
+func Authenticate(ctx context.Context, r io.Reader, clientIP net.IP, heloName, mailFrom string, options *AuthenticateOptions) (*authres.DMARCResult, []authres.Result, error) {
+	if options == nil {
+		options = new(AuthenticateOptions)
+	}
+
+	var b bytes.Buffer
+	if _, err := io.Copy(&b, r); err != nil {
+		return nil, nil, err
+	}
+
+	fromDomain, err := parseFromDomain(bytes.NewReader(b.Bytes()))
+	noFrom := err == errNoFrom
+	if err != nil && !noFrom {
+		return nil, nil, err
+	}
+
+	verifs, err := dkim.VerifyWithContext(ctx, &b, &dkim.VerifyOptions{
+		LookupTXT:        options.LookupTXT,
+		MaxVerifications: options.MaxVerifications,
+	})
+	if err != nil && err != dkim.ErrTooManySignatures {
+		return nil, nil, err
+	}
+
+	var results []authres.Result
+	var dkimDomains []string
+	if len(verifs) == 0 {
+		results = append(results, dkim.NoSignatureResult())
+	}
+	for _, verif := range verifs {
+		results = append(results, verif.AuthResult(""))
+		if verif.Err == nil {
+			dkimDomains = append(dkimDomains, verif.Domain)
+		}
+	}
+
+	var spfDomains []string
+	if options.SPF != nil {
+		results = append(results, options.SPF)
+		if options.SPF.Value == authres.ResultPass {
+			spfDomains = append(spfDomains, spfDomain(heloName, mailFrom))
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if noFrom {
+		dmarcResult := &authres.DMARCResult{
+			Value:  authres.ResultPermError,
+			Reason: "no From header field",
+		}
+		return dmarcResult, append(results, dmarcResult), nil
+	}
+
+	dmarcResult := &authres.DMARCResult{From: fromDomain}
+	ev, err := dmarc.Evaluate(fromDomain, dkimDomains, spfDomains, &dmarc.LookupOptions{
+		LookupTXT: options.LookupTXT,
+	})
+	switch {
+	case err == dmarc.ErrNoPolicy:
+		dmarcResult.Value = authres.ResultNone
+	case dmarc.IsTempFail(err):
+		dmarcResult.Value = authres.ResultTempError
+	case err != nil:
+		dmarcResult.Value = authres.ResultPermError
+	case ev.Pass():
+		dmarcResult.Value = authres.ResultPass
+	default:
+		dmarcResult.Value = authres.ResultFail
+	}
+
+	return dmarcResult, append(results, dmarcResult), nil
+}
+
+// CheckAlignment verifies the DKIM signatures of a message, and reports
+// whether the From domain is aligned with an authenticated DKIM domain or with
+// spfDomain, as defined in RFC 7489 section 3.1. spfDomain is the domain
+// which passed SPF, if any.
+//
+// The alignment modes of the DMARC policy of the From domain are used. If the
+// domain has no DMARC policy, relaxed alignment is used.
+func CheckAlignment(r io.Reader, spfDomain string, options *AuthenticateOptions) (dkimAligned, spfAligned bool, fromDomain string, err error) {
+	if options == nil {
+		options = new(AuthenticateOptions)
+	}
+
+	var b bytes.Buffer
+	if _, err := io.Copy(&b, r); err != nil {
+		return false, false, "", err
+	}
+
+	fromDomain, err = parseFromDomain(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		return false, false, "", err
+	}
+
+	verifs, err := dkim.VerifyWithOptions(&b, &dkim.VerifyOptions{
+		LookupTXT:        options.LookupTXT,
+		MaxVerifications: options.MaxVerifications,
+	})
+	if err != nil && err != dkim.ErrTooManySignatures {
+		return false, false, fromDomain, err
+	}
+	var dkimDomains []string
+	for _, verif := range verifs {
+		if verif.Err == nil {
+			dkimDomains = append(dkimDomains, verif.Domain)
+		}
+	}
+	var spfDomains []string
+	if spfDomain != "" {
+		spfDomains = append(spfDomains, spfDomain)
+	}
+
+	ev, err := dmarc.Evaluate(fromDomain, dkimDomains, spfDomains, &dmarc.LookupOptions{
+		LookupTXT: options.LookupTXT,
+	})
+	if err == nil {
+		return ev.DKIMAligned, ev.SPFAligned, fromDomain, nil
+	} else if err != dmarc.ErrNoPolicy {
+		return false, false, fromDomain, err
+	}
+
+	for _, d := range dkimDomains {
+		if dmarc.IsAligned(fromDomain, d, dmarc.AlignmentRelaxed) {
+			dkimAligned = true
+			break
+		}
+	}
+	spfAligned = spfDomain != "" && dmarc.IsAligned(fromDomain, spfDomain, dmarc.AlignmentRelaxed)
+	return dkimAligned, spfAligned, fromDomain, nil
+}
+
+// AuthResultWithAlignment is like dkim.Verification.AuthResult, but if the
+// signature is valid, the reason reports whether the SDID is aligned with
+// fromDomain, the domain of the From header field. Relaxed alignment is used,
+// as defined in RFC 7489 section 3.1.1.
+//
+// If fromDomain is empty, the result is the same as AuthResult.
+func AuthResultWithAlignment(v *dkim.Verification, fromDomain, identity string) *authres.DKIMResult {
+	res := v.AuthResult(identity)
+	if v.Err != nil || fromDomain == "" {
+		return res
+	}
+	if dmarc.IsAligned(fromDomain, v.Domain, dmarc.AlignmentRelaxed) {
+		res.Reason = "aligned with From"
+	} else {
+		res.Reason = "not aligned with From"
+	}
+	return res
+}
+
+var errNoFrom = errors.New("msgauth: missing From header field")
+
+func parseFromDomain(r io.Reader) (string, error) {
+	msg, err := mail.ReadMessage(bufio.NewReader(r))
+	if err != nil {
+		return "", fmt.Errorf("msgauth: failed to read message header: %v", err)
+	}
+
+	addrs, err := msg.Header.AddressList("From")
+	if err == mail.ErrHeaderNotPresent {
+		return "", errNoFrom
+	} else if err != nil {
+		return "", fmt.Errorf("msgauth: failed to parse From header field: %v", err)
+	} else if len(addrs) != 1 {
+		return "", fmt.Errorf("msgauth: From header field must contain exactly one address")
+	}
+
+	_, domain, ok := strings.Cut(addrs[0].Address, "@")
+	if !ok {
+		return "", fmt.Errorf("msgauth: malformed From address: missing '@'")
+	}
+	return strings.ToLower(domain), nil
+}
+
+func spfDomain(heloName, mailFrom string) string {
+	// The MAIL FROM argument may be passed as a reverse-path, e.g.
+	// "<user@example.com>"
+	mailFrom = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(mailFrom), "<"), ">")
+
+	// RFC 7489 section 3.1.2: if the MAIL FROM is null, the HELO identity is
+	// used
+	if _, domain, ok := strings.Cut(mailFrom, "@"); ok {
+		return domain
+	}
+	return heloName
+}
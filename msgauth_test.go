@@ -0,0 +1,273 @@
+package msgauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+const testMailString = "From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game. Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+var testPrivateKey = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+
+var testDNS = map[string][]string{
+	"brisbane._domainkey.example.com": {
+		"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(testPrivateKey.Public().(ed25519.PublicKey)),
+	},
+	"_dmarc.example.com": {"v=DMARC1; p=reject"},
+}
+
+func lookupTestTXT(domain string) ([]string, error) {
+	if txts, ok := testDNS[domain]; ok {
+		return txts, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+}
+
+func signTestMail(t *testing.T, domain string) string {
+	options := &dkim.SignOptions{
+		Domain:   domain,
+		Selector: "brisbane",
+		Signer:   testPrivateKey,
+	}
+
+	var b bytes.Buffer
+	if err := dkim.Sign(&b, strings.NewReader(testMailString), options); err != nil {
+		t.Fatalf("Expected no error while signing mail, got: %v", err)
+	}
+	return b.String()
+}
+
+func TestAuthenticate(t *testing.T) {
+	signed := signTestMail(t, "example.com")
+
+	tests := []struct {
+		name     string
+		mail     string
+		spf      *authres.SPFResult
+		mailFrom string
+		value    authres.ResultValue
+	}{
+		{
+			name:  "aligned DKIM signature",
+			mail:  signed,
+			value: authres.ResultPass,
+		},
+		{
+			name:  "unsigned",
+			mail:  testMailString,
+			value: authres.ResultFail,
+		},
+		{
+			name:  "aligned SPF",
+			mail:  testMailString,
+			spf:   &authres.SPFResult{Value: authres.ResultPass, From: "bounces.example.com"},
+			value: authres.ResultPass,
+		},
+		{
+			name:  "unaligned SPF",
+			mail:  testMailString,
+			spf:   &authres.SPFResult{Value: authres.ResultPass, From: "example.org"},
+			value: authres.ResultFail,
+		},
+		{
+			name:     "aligned SPF, reverse-path MAIL FROM",
+			mail:     testMailString,
+			spf:      &authres.SPFResult{Value: authres.ResultPass, From: "bounces.example.com"},
+			mailFrom: "<bounce@bounces.example.com>",
+			value:    authres.ResultPass,
+		},
+	}
+
+	for _, test := range tests {
+		options := &AuthenticateOptions{LookupTXT: lookupTestTXT, SPF: test.spf}
+		mailFrom := test.mailFrom
+		if mailFrom == "" && test.spf != nil {
+			mailFrom = "bounce@" + test.spf.From
+		}
+
+		dmarcResult, results, err := Authenticate(context.Background(), strings.NewReader(test.mail), net.IPv4(192, 0, 2, 1), "mail.example.com", mailFrom, options)
+		if err != nil {
+			t.Fatalf("%v: expected no error while authenticating message, got: %v", test.name, err)
+		}
+		if dmarcResult.Value != test.value {
+			t.Errorf("%v: expected DMARC result to be %v, got %v", test.name, test.value, dmarcResult.Value)
+		}
+		if dmarcResult.From != "football.example.com" {
+			t.Errorf("%v: expected DMARC From domain to be %q, got %q", test.name, "football.example.com", dmarcResult.From)
+		}
+		if len(results) == 0 || results[len(results)-1] != dmarcResult {
+			t.Errorf("%v: expected results to end with the DMARC result", test.name)
+		}
+	}
+}
+
+func TestAuthenticate_noPolicy(t *testing.T) {
+	signed := signTestMail(t, "example.com")
+	signed = strings.Replace(signed, "joe@football.example.com>", "joe@example.net>", 1)
+
+	options := &AuthenticateOptions{LookupTXT: lookupTestTXT}
+	dmarcResult, _, err := Authenticate(context.Background(), strings.NewReader(signed), nil, "", "", options)
+	if err != nil {
+		t.Fatalf("Expected no error while authenticating message, got: %v", err)
+	}
+	if dmarcResult.Value != authres.ResultNone {
+		t.Errorf("Expected DMARC result to be %v, got %v", authres.ResultNone, dmarcResult.Value)
+	}
+}
+
+func TestAuthenticate_noFrom(t *testing.T) {
+	mail := strings.Replace(testMailString, "From: ", "Sender: ", 1)
+
+	options := &AuthenticateOptions{LookupTXT: lookupTestTXT}
+	dmarcResult, results, err := Authenticate(context.Background(), strings.NewReader(mail), nil, "", "", options)
+	if err != nil {
+		t.Fatalf("Expected no error while authenticating message, got: %v", err)
+	}
+	if dmarcResult.Value != authres.ResultPermError {
+		t.Errorf("Expected DMARC result to be %v, got %v", authres.ResultPermError, dmarcResult.Value)
+	}
+	if len(results) != 2 {
+		t.Errorf("Expected DKIM and DMARC results, got %v results", len(results))
+	}
+}
+
+func TestCheckAlignment(t *testing.T) {
+	signed := signTestMail(t, "example.com")
+	options := &AuthenticateOptions{LookupTXT: lookupTestTXT}
+
+	tests := []struct {
+		name        string
+		mail        string
+		spfDomain   string
+		dkimAligned bool
+		spfAligned  bool
+	}{
+		{
+			name:        "signed by the From domain",
+			mail:        signed,
+			dkimAligned: true,
+		},
+		{
+			name:       "SPF only",
+			mail:       testMailString,
+			spfDomain:  "bounces.example.com",
+			spfAligned: true,
+		},
+		{
+			name:      "unaligned SPF",
+			mail:      testMailString,
+			spfDomain: "example.net",
+		},
+		{
+			name:        "no DMARC policy",
+			mail:        strings.Replace(signed, "joe@football.example.com>", "joe@example.org>", 1),
+			spfDomain:   "mail.example.org",
+			dkimAligned: false,
+			spfAligned:  true,
+		},
+		{
+			name:       "no DMARC policy, fully-qualified SPF domain",
+			mail:       strings.Replace(testMailString, "joe@football.example.com>", "joe@example.org>", 1),
+			spfDomain:  "Mail.Example.org.",
+			spfAligned: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dkimAligned, spfAligned, _, err := CheckAlignment(strings.NewReader(test.mail), test.spfDomain, options)
+			if err != nil {
+				t.Fatalf("CheckAlignment() = %v", err)
+			}
+			if dkimAligned != test.dkimAligned {
+				t.Errorf("dkimAligned = %v, want %v", dkimAligned, test.dkimAligned)
+			}
+			if spfAligned != test.spfAligned {
+				t.Errorf("spfAligned = %v, want %v", spfAligned, test.spfAligned)
+			}
+		})
+	}
+
+	_, _, fromDomain, err := CheckAlignment(strings.NewReader(signed), "", options)
+	if err != nil {
+		t.Fatalf("CheckAlignment() = %v", err)
+	} else if fromDomain != "football.example.com" {
+		t.Errorf("fromDomain = %q, want %q", fromDomain, "football.example.com")
+	}
+}
+
+func TestAuthResultWithAlignment(t *testing.T) {
+	tests := []struct {
+		domain string
+		reason string
+	}{
+		{"example.com", "aligned with From"},
+		{"example.org", "not aligned with From"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.domain, func(t *testing.T) {
+			verifs, err := dkim.VerifyWithOptions(strings.NewReader(signTestMail(t, test.domain)), &dkim.VerifyOptions{
+				LookupTXT: func(domain string) ([]string, error) {
+					return testDNS["brisbane._domainkey.example.com"], nil
+				},
+			})
+			if err != nil {
+				t.Fatalf("VerifyWithOptions() = %v", err)
+			} else if len(verifs) != 1 {
+				t.Fatalf("Expected exactly one verification, got %v", len(verifs))
+			}
+
+			v := verifs[0]
+			if v.Err != nil {
+				t.Fatalf("Expected no error when verifying signature, got: %v", v.Err)
+			}
+			res := AuthResultWithAlignment(v, "football.example.com", "")
+			if res.Value != authres.ResultPass {
+				t.Errorf("Expected result value to be %v, got %v", authres.ResultPass, res.Value)
+			}
+			if res.Reason != test.reason {
+				t.Errorf("Expected reason to be %q, got %q", test.reason, res.Reason)
+			}
+
+			if res := AuthResultWithAlignment(v, "", ""); res.Reason != "" {
+				t.Errorf("Expected no reason without a From domain, got %q", res.Reason)
+			}
+		})
+	}
+}
+
+func TestSPFDomain(t *testing.T) {
+	tests := []struct {
+		heloName, mailFrom string
+		want               string
+	}{
+		{"mail.example.org", "bounce@example.com", "example.com"},
+		{"mail.example.org", "<bounce@example.com>", "example.com"},
+		{"mail.example.org", "", "mail.example.org"},
+		{"mail.example.org", "<>", "mail.example.org"},
+	}
+	for _, test := range tests {
+		if got := spfDomain(test.heloName, test.mailFrom); got != test.want {
+			t.Errorf("spfDomain(%q, %q) = %q, want %q", test.heloName, test.mailFrom, got, test.want)
+		}
+	}
+}